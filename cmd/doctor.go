@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"nats-jetstream/config"
+)
+
+// runDoctor checks the prerequisites of the configured sync and prints how
+// to fix what is missing. It exits non-zero if a check failed.
+//
+//	doctor
+func runDoctor(args []string) error {
+    ctx := context.Background()
+    logger := log.New(os.Stderr, "SyncMeilisearch: ", log.LstdFlags)
+    
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load configuration: %w", err)
+    }
+    
+    db, err := config.NewDatabase(ctx, logger)
+    if err != nil {
+        return fmt.Errorf("database setup failed: %w", err)
+    }
+    defer db.Close()
+    
+    failed := 0
+    for _, check := range config.Diagnose(ctx, cfg, db.DB) {
+        fmt.Printf("[%-4s] %s: %s\n", strings.ToUpper(check.Status), check.Name, check.Detail)
+        if check.Fix != "" && check.Status != config.CheckOK {
+            fmt.Printf("       fix: %s\n", check.Fix)
+        }
+        if check.Status == config.CheckFail {
+            failed++
+        }
+    }
+    
+    if failed > 0 {
+        return fmt.Errorf("%d check(s) failed", failed)
+    }
+    fmt.Println("All checks passed")
+    return nil
+}
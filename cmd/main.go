@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"nats-jetstream/config"
+	"nats-jetstream/pkg/metrics"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
@@ -13,6 +14,19 @@ import (
 
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "replay" {
+        if err := runReplay(os.Args[2:]); err != nil {
+            log.Fatal("Replay failed: ", err)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "doctor" {
+        if err := runDoctor(os.Args[2:]); err != nil {
+            log.Fatal("Doctor: ", err)
+        }
+        return
+    }
+    
     ctx := context.Background()
     logger := log.New(os.Stdout, "SyncMeilisearch: ", log.LstdFlags)
     
@@ -22,6 +36,10 @@ func main() {
         log.Fatal("Failed to load configuration:", err)
     }
     
+    if config.MetricsAddr != "" {
+        metrics.Serve(config.MetricsAddr, logger)
+    }
+    
     // Setup database
     db, err := config.NewDatabase(ctx, logger)
     if err != nil {
@@ -29,21 +47,42 @@ func main() {
     }
     defer db.Close()
     
-    // Setup sync manager
-    syncManager := config.NewManager(cfg, db, logger)
-    if err := syncManager.Initialize(); err != nil {
-        logger.Fatal("Sync manager initialization failed:", err)
+    // Expand table patterns such as catalog.*
+    if cfg.Sync, err = config.ExpandSync(ctx, db.DB, cfg.Sync); err != nil {
+        logger.Fatal("Table expansion failed:", err)
+    }
+    if cfg.Sync, err = config.ResolvePrimaryKeys(ctx, db.DB, cfg.Sync, logger); err != nil {
+        logger.Fatal("Primary key lookup failed:", err)
     }
     
     // Setup streaming service
     streamingService := config.NewService(cfg, logger)
     
+    // Setup checkpoint store
+    checkpoints, err := streamingService.CheckpointStore(ctx, db)
+    if err != nil {
+        logger.Fatal("Checkpoint store setup failed:", err)
+    }
+    
+    // Setup sync manager
+    syncManager := config.NewManager(cfg, db, checkpoints, logger)
+    if err := syncManager.ClaimSlot(ctx); err != nil {
+        logger.Fatal("Replication slot setup failed:", err)
+    }
+    if err := syncManager.ReconcilePublication(ctx); err != nil {
+        logger.Fatal("Publication setup failed:", err)
+    }
+    if err := syncManager.Initialize(); err != nil {
+        logger.Fatal("Sync manager initialization failed:", err)
+    }
+    
     // Start replication
     if err := streamingService.StartReplication(
         ctx,
         syncManager.GetWALCallback(),
-        syncManager.GetTableNames(),
-        syncManager.GetHandlers(),
+        syncManager.GetReplicationConfig(),
+        syncManager.GetMessageHandler(),
+        syncManager.GetBatchHandler(),
     ); err != nil {
         logger.Fatal("Failed to start replication:", err)
     }
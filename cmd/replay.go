@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/nat"
+)
+
+// runReplay rebuilds Meilisearch indexes from the change events kept in the
+// JetStream stream, without reading from Postgres.
+//
+//	replay -from-seq 1200 -tables products,orders
+//	replay -from-time 2026-10-01T00:00:00Z
+func runReplay(args []string) error {
+    flags := flag.NewFlagSet("replay", flag.ExitOnError)
+    fromSeq := flags.Uint64("from-seq", 0, "stream sequence to start from")
+    fromTime := flags.String("from-time", "", "RFC 3339 time to start from")
+    tables := flags.String("tables", "", "comma-separated tables to replay (default: all)")
+    idle := flags.Duration("idle-timeout", 5*time.Second, "stop when no message arrives for this long")
+    flags.Parse(args)
+    
+    opts := nat.ReplayOptions{
+        StartSequence: *fromSeq,
+        IdleTimeout:   *idle,
+    }
+    if *fromTime != "" {
+        t, err := time.Parse(time.RFC3339, *fromTime)
+        if err != nil {
+            return fmt.Errorf("invalid -from-time: %w", err)
+        }
+        opts.StartTime = t
+    }
+    if *tables != "" {
+        opts.Tables = strings.Split(*tables, ",")
+    }
+    
+    ctx := context.Background()
+    logger := log.New(os.Stdout, "SyncMeilisearch: ", log.LstdFlags)
+    
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load configuration: %w", err)
+    }
+    
+    var db *config.DatabaseStruct
+    if config.HasWildcards(cfg.Sync) || config.HasMissingKeys(cfg.Sync) || config.HasRowFilters(cfg.Sync) {
+        db, err = config.NewDatabase(ctx, logger)
+        if err != nil {
+            return fmt.Errorf("database setup failed: %w", err)
+        }
+        defer db.Close()
+        if cfg.Sync, err = config.ExpandSync(ctx, db.DB, cfg.Sync); err != nil {
+            return fmt.Errorf("table expansion failed: %w", err)
+        }
+        if cfg.Sync, err = config.ResolvePrimaryKeys(ctx, db.DB, cfg.Sync, logger); err != nil {
+            return fmt.Errorf("primary key lookup failed: %w", err)
+        }
+    }
+    
+    syncManager := config.NewManager(cfg, db, nil, logger)
+    if err := syncManager.InitializeForReplay(); err != nil {
+        return fmt.Errorf("sync manager initialization failed: %w", err)
+    }
+    
+    return config.NewService(cfg, logger).Replay(ctx, opts, syncManager.GetMessageHandler())
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"nats-jetstream/pkg/checkpoint"
+	"nats-jetstream/pkg/nat"
+)
+
+const (
+    defaultCheckpointPath   = "./data/checkpoints.json"
+    defaultCheckpointBucket = "syncmeili_checkpoints"
+)
+
+// CheckpointStore builds the store configured under checkpoint:, defaulting
+// to a local file. The nats type connects to JetStream.
+func (s *Service) CheckpointStore(ctx context.Context, db *DatabaseStruct) (checkpoint.Store, error) {
+    cfg := s.config.Checkpoint
+    
+    switch cfg.Type {
+    case "", "file":
+        path := cfg.Path
+        if path == "" {
+            path = defaultCheckpointPath
+        }
+        return checkpoint.NewFileStore(path)
+    case "postgres":
+        return checkpoint.NewPostgresStore(ctx, db.DB)
+    case "nats":
+        _, js, err := s.connect(ctx)
+        if err != nil {
+            return nil, fmt.Errorf("failed to connect to NATS JetStream: %w", err)
+        }
+        bucket := cfg.Bucket
+        if bucket == "" {
+            bucket = defaultCheckpointBucket
+        }
+        return checkpoint.NewKVStore(js.(*nat.JetStreamContextImpl).JS, bucket)
+    default:
+        return nil, fmt.Errorf("unknown checkpoint type: %s", cfg.Type)
+    }
+}
@@ -1,8 +1,16 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
 
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
@@ -12,9 +20,28 @@ type ApplicationConfig struct {
     Initialize   bool          `yaml:"initialize"`
     Database     DatabaseConfig `yaml:"database"`
     MeiliSearch  MeiliSearchConfig `yaml:"meilisearch"`
+    Checkpoint   CheckpointConfig `yaml:"checkpoint"`
+    Replication  ReplicationSettings `yaml:"replication"`
     Sync         []SyncConfig  `yaml:"sync"`
 }
 
+// CheckpointConfig selects where progress is persisted: a local file, the
+// syncmeili_checkpoints table in the source database, or a JetStream
+// key-value bucket.
+type CheckpointConfig struct {
+    Type   string `yaml:"type"`
+    Path   string `yaml:"path,omitempty"`
+    Bucket string `yaml:"bucket,omitempty"`
+}
+
+// ReplicationSettings names the Postgres objects owned by this instance.
+// Deployments sharing a database need distinct slot and publication names.
+type ReplicationSettings struct {
+    Slot            string `yaml:"slot"`
+    Publication     string `yaml:"publication"`
+    ApplicationName string `yaml:"application_name"`
+}
+
 type DatabaseConfig struct {
     Host     string `yaml:"host"`
     Port     string `yaml:"port"`
@@ -38,7 +65,132 @@ type MeiliSearch interface {
 type SyncConfig struct {
     Table string `yaml:"table"`
     Index string `yaml:"index"`
-    PK    string `yaml:"pk,omitempty"`
+    // PK is the key column, or a list of columns for a composite key.
+    PK    KeyColumns `yaml:"pk,omitempty"`
+    // IDStrategy turns the key into a document id: raw (default), slugify,
+    // base32 or hash.
+    IDStrategy string `yaml:"id_strategy,omitempty"`
+    // IDField names the document attribute holding the encoded key when the
+    // key is composite or IDStrategy is not raw. Defaults to
+    // meilisearch.DefaultIDField.
+    IDField string `yaml:"id_field,omitempty"`
+    // Where is a SQL boolean expression over the table's columns, for
+    // example "status = 'published'". Only matching rows are indexed.
+    Where   string   `yaml:"where,omitempty"`
+    // Columns limits the indexed columns. The primary key is always kept.
+    Columns []string `yaml:"columns,omitempty"`
+    // Toast is "partial" (default) to write updates with unchanged TOASTed
+    // columns as partial updates, or "fetch" to read them from Postgres.
+    Toast   string   `yaml:"toast,omitempty"`
+    // WriteMode is "replace" (default) to replace documents on every change,
+    // or "merge" to update only the columns from Postgres and keep fields
+    // added by other writers.
+    WriteMode string `yaml:"write_mode,omitempty"`
+    // IgnoreColumns are left out of the documents; updates that change only
+    // them are not written. Such updates are recognized from the old row
+    // with REPLICA IDENTITY FULL, or through a cache of HashCacheSize
+    // document hashes. The soft-delete column cannot be ignored.
+    IgnoreColumns []string `yaml:"ignore_columns,omitempty"`
+    HashCacheSize int      `yaml:"hash_cache_size,omitempty"`
+    // CoalesceWindow holds a table's changes that long, for example "250ms",
+    // and writes only the last state of each row. It applies to the pull
+    // consumer and to direct mode.
+    CoalesceWindow time.Duration `yaml:"coalesce_window,omitempty"`
+    // SoftDelete treats rows matching a column condition as deleted.
+    SoftDelete *SoftDeleteConfig `yaml:"soft_delete,omitempty"`
+    // Geo builds the _geo attribute from lat/lng columns or a PostGIS point.
+    Geo *GeoConfig `yaml:"geo,omitempty"`
+    // Vectors maps pgvector columns to Meilisearch user-provided embedders.
+    Vectors []VectorConfig `yaml:"vectors,omitempty"`
+}
+
+// VectorConfig sends a pgvector column as the embedding of an embedder, for
+// example {column: embedding, embedder: default}. Dimensions defaults to n
+// of the column's vector(n) type.
+type VectorConfig struct {
+    Column     string `yaml:"column"`
+    Embedder   string `yaml:"embedder,omitempty"`
+    Dimensions int    `yaml:"dimensions,omitempty"`
+}
+
+func (s SyncConfig) vectorMappings() []meilisearch.VectorMapping {
+    var mappings []meilisearch.VectorMapping
+    for _, v := range s.Vectors {
+        mappings = append(mappings, meilisearch.VectorMapping{Column: v.Column, Embedder: v.Embedder, Dimensions: v.Dimensions})
+    }
+    return mappings
+}
+
+// GeoConfig maps a table's coordinates to _geo, either {lat: latitude,
+// lng: longitude} or {column: location} for a PostGIS point.
+type GeoConfig struct {
+    Lat    string `yaml:"lat,omitempty"`
+    Lng    string `yaml:"lng,omitempty"`
+    Column string `yaml:"column,omitempty"`
+}
+
+func (g *GeoConfig) mapping() *meilisearch.GeoMapping {
+    if g == nil {
+        return nil
+    }
+    return &meilisearch.GeoMapping{Lat: g.Lat, Lng: g.Lng, Column: g.Column}
+}
+
+// SoftDeleteConfig is the soft-delete rule of a table, for example
+// {column: deleted_at} or {column: status, condition: equals, value: deleted}.
+type SoftDeleteConfig struct {
+    Column    string `yaml:"column"`
+    Condition string `yaml:"condition,omitempty"` // not_null (default), true or equals
+    Value     string `yaml:"value,omitempty"`
+}
+
+func (s *SoftDeleteConfig) rule() *meilisearch.SoftDeleteRule {
+    if s == nil {
+        return nil
+    }
+    return &meilisearch.SoftDeleteRule{Column: s.Column, Condition: s.Condition, Value: s.Value}
+}
+
+// KeyColumns is written in YAML as a single column name or as a list.
+type KeyColumns []string
+
+func (k *KeyColumns) UnmarshalYAML(node *yaml.Node) error {
+    switch node.Kind {
+    case yaml.ScalarNode:
+        *k = nil
+        if node.Value != "" {
+            *k = KeyColumns{node.Value}
+        }
+        return nil
+    case yaml.SequenceNode:
+        var columns []string
+        if err := node.Decode(&columns); err != nil {
+            return err
+        }
+        *k = columns
+        return nil
+    }
+    return fmt.Errorf("line %d: pk must be a column name or a list of column names", node.Line)
+}
+
+func (k KeyColumns) String() string {
+    return strings.Join(k, ", ")
+}
+
+// DocumentID returns the Meilisearch primary key of the entry's index: the
+// key column itself, or the synthetic id attribute for a composite or
+// encoded key.
+func (s SyncConfig) DocumentID() string {
+    if meilisearch.SyntheticID(s.IDStrategy, s.PK) {
+        if s.IDField != "" {
+            return s.IDField
+        }
+        return meilisearch.DefaultIDField
+    }
+    if len(s.PK) == 1 {
+        return s.PK[0]
+    }
+    return ""
 }
 
 var (
@@ -50,6 +202,30 @@ var (
 	DurableName  string
 	Url          string
 
+    NatsCredsFile       string
+    NatsNKeyFile        string
+    NatsUser            string
+    NatsPassword        string
+    NatsToken           string
+    NatsTLSCA           string
+    NatsTLSCert         string
+    NatsTLSKey          string
+    NatsMaxReconnects   int
+    NatsReconnectWait   time.Duration
+    NatsReconnectJitter time.Duration
+    MetricsAddr         string
+    NatsEmbedded      bool
+    NatsStoreDir      string
+    NatsEmbeddedPort  int
+
+    EventFormat       string
+    ConsumerMode      string
+    PullBatchSize     int
+    PullMaxAckPending int
+    PullFetchTimeout  time.Duration
+    ApplyWorkers      int
+    ApplyQueueDepth   int
+
     app *ApplicationConfig
 )
 
@@ -67,6 +243,65 @@ func Load() (*ApplicationConfig, error) {
     DurableName = os.Getenv("DURABLE_NAME")
     Url = os.Getenv("NATS_URL")
 
+    NatsCredsFile = os.Getenv("NATS_CREDS")
+    NatsNKeyFile = os.Getenv("NATS_NKEY")
+    NatsUser = os.Getenv("NATS_USER")
+    NatsPassword = os.Getenv("NATS_PASSWORD")
+    NatsToken = os.Getenv("NATS_TOKEN")
+    NatsTLSCA = os.Getenv("NATS_TLS_CA")
+    NatsTLSCert = os.Getenv("NATS_TLS_CERT")
+    NatsTLSKey = os.Getenv("NATS_TLS_KEY")
+    if (NatsTLSCert == "") != (NatsTLSKey == "") {
+        return nil, fmt.Errorf("NATS_TLS_CERT and NATS_TLS_KEY must be set together")
+    }
+    if NatsMaxReconnects, err = envInt("NATS_MAX_RECONNECTS"); err != nil {
+        return nil, err
+    }
+    if NatsReconnectWait, err = envDuration("NATS_RECONNECT_WAIT"); err != nil {
+        return nil, err
+    }
+    if NatsReconnectJitter, err = envDuration("NATS_RECONNECT_JITTER"); err != nil {
+        return nil, err
+    }
+    MetricsAddr = os.Getenv("METRICS_ADDR")
+    
+    NatsEmbedded = os.Getenv("NATS_EMBEDDED") == "true"
+    NatsStoreDir = os.Getenv("NATS_STORE_DIR")
+    if NatsStoreDir == "" {
+        NatsStoreDir = "./data/nats"
+    }
+    NatsEmbeddedPort = 4222
+    if os.Getenv("NATS_EMBEDDED_PORT") != "" {
+        if NatsEmbeddedPort, err = envInt("NATS_EMBEDDED_PORT"); err != nil {
+            return nil, err
+        }
+    }
+
+    EventFormat = os.Getenv("EVENT_FORMAT")
+    if EventFormat != "" && EventFormat != postgres.FormatEnvelope && EventFormat != postgres.FormatDebezium {
+        return nil, fmt.Errorf("invalid EVENT_FORMAT %q: expected %q or %q", EventFormat, postgres.FormatEnvelope, postgres.FormatDebezium)
+    }
+
+    ConsumerMode = os.Getenv("CONSUMER_MODE")
+    if PullBatchSize, err = envInt("PULL_BATCH_SIZE"); err != nil {
+        return nil, err
+    }
+    if PullMaxAckPending, err = envInt("PULL_MAX_ACK_PENDING"); err != nil {
+        return nil, err
+    }
+    if PullFetchTimeout, err = envDuration("PULL_FETCH_TIMEOUT"); err != nil {
+        return nil, err
+    }
+    if ApplyWorkers, err = envInt("APPLY_WORKERS"); err != nil {
+        return nil, err
+    }
+    if ApplyQueueDepth, err = envInt("APPLY_QUEUE_DEPTH"); err != nil {
+        return nil, err
+    }
+    if ApplyWorkers < 0 || ApplyQueueDepth < 0 {
+        return nil, fmt.Errorf("APPLY_WORKERS and APPLY_QUEUE_DEPTH must not be negative")
+    }
+
     data, err := os.ReadFile("config.yaml")
     if err != nil {
         log.Fatalf("Failed to read YAML file: %v", err)
@@ -78,6 +313,81 @@ func Load() (*ApplicationConfig, error) {
         log.Fatalf("Failed to parse YAML file: %v", err)
     }
 
+    for _, syncCfg := range config.Sync {
+        if syncCfg.Toast != "" && syncCfg.Toast != meilisearch.ToastPartial && syncCfg.Toast != meilisearch.ToastFetch {
+            return nil, fmt.Errorf("invalid toast mode %q for table %s: expected %q or %q", syncCfg.Toast, syncCfg.Table, meilisearch.ToastPartial, meilisearch.ToastFetch)
+        }
+        if syncCfg.CoalesceWindow < 0 {
+            return nil, fmt.Errorf("invalid coalesce_window %s for table %s", syncCfg.CoalesceWindow, syncCfg.Table)
+        }
+        if syncCfg.WriteMode != "" && syncCfg.WriteMode != meilisearch.WriteReplace && syncCfg.WriteMode != meilisearch.WriteMerge {
+            return nil, fmt.Errorf("invalid write_mode %q for table %s: expected %q or %q", syncCfg.WriteMode, syncCfg.Table, meilisearch.WriteReplace, meilisearch.WriteMerge)
+        }
+        for _, column := range syncCfg.IgnoreColumns {
+            if slices.Contains(syncCfg.PK, column) {
+                return nil, fmt.Errorf("table %s: key column %s cannot be ignored", syncCfg.Table, column)
+            }
+            if syncCfg.SoftDelete != nil && syncCfg.SoftDelete.Column == column {
+                return nil, fmt.Errorf("table %s: soft_delete column %s cannot be ignored", syncCfg.Table, column)
+            }
+        }
+        if syncCfg.SoftDelete != nil {
+            if err := syncCfg.SoftDelete.rule().Validate(); err != nil {
+                return nil, fmt.Errorf("table %s: %w", syncCfg.Table, err)
+            }
+        }
+        if syncCfg.Geo != nil {
+            if err := syncCfg.Geo.mapping().Validate(); err != nil {
+                return nil, fmt.Errorf("table %s: %w", syncCfg.Table, err)
+            }
+        }
+        if err := meilisearch.ValidateVectors(syncCfg.vectorMappings()); err != nil {
+            return nil, fmt.Errorf("table %s: %w", syncCfg.Table, err)
+        }
+        switch syncCfg.IDStrategy {
+        case "", meilisearch.IDRaw, meilisearch.IDSlugify, meilisearch.IDBase32, meilisearch.IDHash:
+        default:
+            return nil, fmt.Errorf("invalid id_strategy %q for table %s: expected raw, slugify, base32 or hash", syncCfg.IDStrategy, syncCfg.Table)
+        }
+    }
+    
+    if config.Replication.Slot == "" {
+        config.Replication.Slot = postgres.DefaultSlotName
+    }
+    if config.Replication.Publication == "" {
+        config.Replication.Publication = postgres.DefaultPublicationName
+    }
+    if config.Replication.ApplicationName == "" {
+        config.Replication.ApplicationName = postgres.DefaultApplicationName
+    }
+    
     app = &config
 	return app, nil
-}
\ No newline at end of file
+}
+
+// envInt reads an optional integer variable; unset means 0 so callers can
+// apply their own defaults.
+func envInt(name string) (int, error) {
+    value := os.Getenv(name)
+    if value == "" {
+        return 0, nil
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+    }
+    return n, nil
+}
+
+// envDuration reads an optional duration variable such as "5s".
+func envDuration(name string) (time.Duration, error) {
+    value := os.Getenv(name)
+    if value == "" {
+        return 0, nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+    }
+    return d, nil
+}
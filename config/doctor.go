@@ -0,0 +1,328 @@
+package config
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+
+    "nats-jetstream/pkg/meilisearch"
+    "nats-jetstream/pkg/postgres"
+
+    "github.com/jackc/pgx/v5"
+    meili "github.com/meilisearch/meilisearch-go"
+)
+
+// Check is the outcome of one preflight check. Fix holds the remediation,
+// usually SQL to run, when the check did not pass.
+type Check struct {
+    Name   string
+    Status string
+    Detail string
+    Fix    string
+}
+
+const (
+    CheckOK   = "ok"
+    CheckWarn = "warn"
+    CheckFail = "fail"
+)
+
+// Diagnose checks the Postgres and Meilisearch prerequisites of the
+// configured sync entries, without changing anything.
+func Diagnose(ctx context.Context, cfg *ApplicationConfig, db *sql.DB) []Check {
+    var checks []Check
+    
+    if err := db.PingContext(ctx); err != nil {
+        checks = append(checks, Check{
+            Name:   "postgres connection",
+            Status: CheckFail,
+            Detail: err.Error(),
+            Fix:    "check the database section of config.yaml and that Postgres accepts connections from this host",
+        })
+        return append(checks, diagnoseMeilisearch(cfg)...)
+    }
+    
+    walLevel := diagnoseWALLevel(ctx, db)
+    checks = append(checks, walLevel, diagnoseSlots(ctx, db, cfg.Replication.Slot), diagnoseWalSenders(ctx, db))
+    if walLevel.Status == CheckOK {
+        checks = append(checks, diagnoseWAL2JSON(ctx, db))
+    }
+    checks = append(checks, diagnosePrivileges(ctx, db)...)
+    
+    entries, err := ExpandSync(ctx, db, cfg.Sync)
+    if err != nil {
+        checks = append(checks, Check{Name: "sync tables", Status: CheckFail, Detail: err.Error()})
+    } else {
+        for _, entry := range entries {
+            checks = append(checks, diagnoseTable(ctx, db, cfg.Replication.Publication, entry)...)
+        }
+    }
+    
+    return append(checks, diagnoseMeilisearch(cfg)...)
+}
+
+func diagnoseWALLevel(ctx context.Context, db *sql.DB) Check {
+    check := Check{Name: "wal_level"}
+    var level string
+    if err := db.QueryRowContext(ctx, "SHOW wal_level").Scan(&level); err != nil {
+        check.Status, check.Detail = CheckFail, err.Error()
+        return check
+    }
+    if level != "logical" {
+        check.Status = CheckFail
+        check.Detail = fmt.Sprintf("wal_level is %s, logical decoding needs logical", level)
+        check.Fix = "ALTER SYSTEM SET wal_level = logical; -- then restart Postgres"
+        return check
+    }
+    check.Status, check.Detail = CheckOK, "wal_level is logical"
+    return check
+}
+
+func diagnoseSlots(ctx context.Context, db *sql.DB, slot string) Check {
+    check := Check{Name: "replication slots"}
+    var max, used int
+    var exists bool
+    err := db.QueryRowContext(ctx, `SELECT current_setting('max_replication_slots')::int,
+            (SELECT count(*) FROM pg_replication_slots),
+            EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, slot).Scan(&max, &used, &exists)
+    if err != nil {
+        check.Status, check.Detail = CheckFail, err.Error()
+        return check
+    }
+    switch {
+    case exists:
+        check.Status, check.Detail = CheckOK, fmt.Sprintf("slot %s exists (%d of %d slots used)", slot, used, max)
+    case used >= max:
+        check.Status = CheckFail
+        check.Detail = fmt.Sprintf("all %d replication slots are in use and slot %s does not exist", max, slot)
+        check.Fix = fmt.Sprintf("ALTER SYSTEM SET max_replication_slots = %d; -- then restart Postgres, or drop an unused slot with pg_drop_replication_slot", max+1)
+    default:
+        check.Status, check.Detail = CheckOK, fmt.Sprintf("%d of %d slots free", max-used, max)
+    }
+    return check
+}
+
+func diagnoseWalSenders(ctx context.Context, db *sql.DB) Check {
+    check := Check{Name: "wal senders"}
+    var max, used int
+    err := db.QueryRowContext(ctx, `SELECT current_setting('max_wal_senders')::int,
+            (SELECT count(*) FROM pg_stat_replication)`).Scan(&max, &used)
+    if err != nil {
+        check.Status, check.Detail = CheckFail, err.Error()
+        return check
+    }
+    if used >= max {
+        check.Status = CheckFail
+        check.Detail = fmt.Sprintf("all %d wal senders are in use", max)
+        check.Fix = fmt.Sprintf("ALTER SYSTEM SET max_wal_senders = %d; -- then restart Postgres", max+1)
+        return check
+    }
+    check.Status, check.Detail = CheckOK, fmt.Sprintf("%d of %d wal senders free", max-used, max)
+    return check
+}
+
+// diagnoseWAL2JSON creates and drops a throwaway slot to prove the output
+// plugin is installed and loadable.
+func diagnoseWAL2JSON(ctx context.Context, db *sql.DB) Check {
+    check := Check{Name: "wal2json"}
+    
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        check.Status, check.Detail = CheckFail, err.Error()
+        return check
+    }
+    defer conn.Close()
+    
+    slot := fmt.Sprintf("syncmeili_doctor_%d", os.Getpid())
+    if _, err := conn.ExecContext(ctx, "SELECT pg_create_logical_replication_slot($1, 'wal2json', true)", slot); err != nil {
+        check.Status = CheckFail
+        check.Detail = err.Error()
+        if strings.Contains(err.Error(), "wal2json") {
+            check.Fix = "install the wal2json plugin on the database server, e.g. apt install postgresql-<version>-wal2json"
+        }
+        return check
+    }
+    conn.ExecContext(ctx, "SELECT pg_drop_replication_slot($1)", slot)
+    
+    check.Status, check.Detail = CheckOK, "wal2json is installed"
+    return check
+}
+
+func diagnosePrivileges(ctx context.Context, db *sql.DB) []Check {
+    var user string
+    var replication, create bool
+    err := db.QueryRowContext(ctx, `SELECT current_user, rolreplication OR rolsuper,
+            has_database_privilege(current_database(), 'CREATE')
+        FROM pg_roles WHERE rolname = current_user`).Scan(&user, &replication, &create)
+    if err != nil {
+        return []Check{{Name: "privileges", Status: CheckFail, Detail: err.Error()}}
+    }
+    
+    role := pgx.Identifier{user}.Sanitize()
+    checks := []Check{{Name: "replication privilege", Status: CheckOK, Detail: fmt.Sprintf("role %s may replicate", user)}}
+    if !replication {
+        checks[0] = Check{
+            Name:   "replication privilege",
+            Status: CheckFail,
+            Detail: fmt.Sprintf("role %s has no REPLICATION attribute", user),
+            Fix:    fmt.Sprintf("ALTER ROLE %s WITH REPLICATION;", role),
+        }
+    }
+    
+    if create {
+        checks = append(checks, Check{Name: "create privilege", Status: CheckOK, Detail: fmt.Sprintf("role %s may create publications", user)})
+    } else {
+        checks = append(checks, Check{
+            Name:   "create privilege",
+            Status: CheckFail,
+            Detail: fmt.Sprintf("role %s cannot create publications in this database", user),
+            Fix:    fmt.Sprintf("GRANT CREATE ON DATABASE %s TO %s;", pgx.Identifier{postgres.Database}.Sanitize(), role),
+        })
+    }
+    return checks
+}
+
+// diagnoseTable checks that a table exists, that its deletes and updates
+// carry the old key, that pk matches the table's key and that the
+// publication does not filter the table.
+func diagnoseTable(ctx context.Context, db *sql.DB, publication string, entry SyncConfig) []Check {
+    table := postgres.ParseTableName(entry.Table)
+    name := "table " + table.String()
+    quoted := table.Sanitize()
+    
+    var identity string
+    var hasPK, hasIdentityIndex bool
+    err := db.QueryRowContext(ctx, `SELECT c.relreplident::text,
+            EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary),
+            EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisreplident)
+        FROM pg_class c WHERE c.oid = to_regclass($1)`, quoted).Scan(&identity, &hasPK, &hasIdentityIndex)
+    if errors.Is(err, sql.ErrNoRows) {
+        return []Check{{Name: name, Status: CheckFail, Detail: "table does not exist", Fix: "fix the table name in the sync section of config.yaml"}}
+    }
+    if err != nil {
+        return []Check{{Name: name, Status: CheckFail, Detail: err.Error()}}
+    }
+    
+    var checks []Check
+    switch {
+    case identity == "f":
+        checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "replica identity full"})
+    case identity == "d" && hasPK:
+        checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "replica identity uses the primary key"})
+    case identity == "i" && hasIdentityIndex:
+        checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "replica identity uses an index"})
+    default:
+        fix := fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL;", quoted)
+        if !hasPK && len(entry.PK) > 0 {
+            keys := make([]string, len(entry.PK))
+            for i, key := range entry.PK {
+                keys[i] = pgx.Identifier{key}.Sanitize()
+            }
+            fix = fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (%s); -- or: %s", quoted, strings.Join(keys, ", "), fix)
+        }
+        checks = append(checks, Check{
+            Name:   name,
+            Status: CheckFail,
+            Detail: "no primary key or replica identity: updates and deletes arrive without old keys",
+            Fix:    fix,
+        })
+    }
+    
+    if pk, err := resolvePrimaryKey(ctx, db, entry); err != nil {
+        checks = append(checks, Check{
+            Name:   name,
+            Status: CheckFail,
+            Detail: err.Error(),
+            Fix:    "fix or remove pk in the sync section of config.yaml",
+        })
+    } else {
+        if len(entry.PK) == 0 {
+            checks = append(checks, Check{Name: name, Status: CheckOK, Detail: fmt.Sprintf("pk %s taken from the primary key", pk)})
+        }
+        entry.PK = pk
+        if check, ok := diagnoseIndexColumns(ctx, db, entry); ok {
+            checks = append(checks, check)
+        }
+    }
+    
+    // where and columns are applied by the sync. In the publication, a row
+    // filter on columns outside the replica identity, or a column list not
+    // covering it, makes Postgres reject the table's UPDATEs and DELETEs.
+    if filtered, err := postgres.PublicationFiltered(ctx, db, publication, entry.Table); err != nil {
+        checks = append(checks, Check{Name: name, Status: CheckFail, Detail: err.Error()})
+    } else if filtered {
+        pub := pgx.Identifier{publication}.Sanitize()
+        checks = append(checks, Check{
+            Name:   name,
+            Status: CheckFail,
+            Detail: fmt.Sprintf("publication %s has a row filter or column list on the table, which can make Postgres reject its updates and deletes", publication),
+            Fix:    fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s; ALTER PUBLICATION %s ADD TABLE %s; -- or restart the sync, which removes it", pub, quoted, pub, quoted),
+        })
+    }
+    
+    return checks
+}
+
+// diagnoseIndexColumns checks that the columns of an index template are
+// part of the old row Postgres sends for updates and deletes, so the index
+// holding a row's document can be found. ok is false for a plain index name.
+func diagnoseIndexColumns(ctx context.Context, db *sql.DB, entry SyncConfig) (check Check, ok bool) {
+    if len(meilisearch.IndexColumns(entry.Index)) == 0 {
+        return Check{}, false
+    }
+    name := "index " + entry.Index
+    if err := checkIndexColumns(ctx, db, entry); err != nil {
+        return Check{
+            Name:   name,
+            Status: CheckFail,
+            Detail: err.Error(),
+            Fix:    fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL;", postgres.ParseTableName(entry.Table).Sanitize()),
+        }, true
+    }
+    return Check{Name: name, Status: CheckOK, Detail: "template columns are sent with the old row"}, true
+}
+
+// diagnoseMeilisearch verifies the API key against the server and every
+// configured index.
+func diagnoseMeilisearch(cfg *ApplicationConfig) []Check {
+    client := meili.New(cfg.MeiliSearch.ApiUrl, meili.WithAPIKey(cfg.MeiliSearch.ApiKey))
+    
+    if _, err := client.Version(); err != nil {
+        return []Check{{
+            Name:   "meilisearch",
+            Status: CheckFail,
+            Detail: err.Error(),
+            Fix:    "check meilisearch.api_url and meilisearch.api_key in config.yaml; the key needs the indexes and documents actions",
+        }}
+    }
+    
+    checks := []Check{{Name: "meilisearch", Status: CheckOK, Detail: "API key accepted"}}
+    seen := make(map[string]bool)
+    for _, entry := range cfg.Sync {
+        if seen[entry.Index] || strings.Contains(entry.Index, "{") {
+            continue
+        }
+        seen[entry.Index] = true
+        
+        name := "index " + entry.Index
+        if _, err := client.GetIndex(entry.Index); err != nil {
+            var apiErr *meili.Error
+            if errors.As(err, &apiErr) && apiErr.MeilisearchApiError.Code == "index_not_found" {
+                checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "does not exist yet and will be created"})
+                continue
+            }
+            checks = append(checks, Check{
+                Name:   name,
+                Status: CheckFail,
+                Detail: err.Error(),
+                Fix:    "give the API key access to this index",
+            })
+            continue
+        }
+        checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "accessible"})
+    }
+    return checks
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 
-	"nats-jetstream/pkg/meilisearch"
 	"nats-jetstream/pkg/nat"
 	"nats-jetstream/pkg/postgres"
 )
@@ -13,6 +12,9 @@ import (
 type Service struct {
     config     *ApplicationConfig
     logger     *log.Logger
+    
+    nc         nat.NATSConnection
+    js         nat.JetStreamContext
 }
 
 func NewService(cfg *ApplicationConfig, logger *log.Logger) *Service {
@@ -22,39 +24,132 @@ func NewService(cfg *ApplicationConfig, logger *log.Logger) *Service {
     }
 }
 
-func (s *Service) StartReplication(ctx context.Context, walCallback func([]byte), tableNames []string, handlers []*meilisearch.MeiliSearchHandler) error {
+func (s *Service) StartReplication(ctx context.Context, walCallback func([]byte), replication postgres.ReplicationConfig, messageHandler nat.MessageHandler, batchHandler nat.BatchMessageHandler) error {
     if StreamService == "jetstream" {
-        return s.startJetStreamReplication(ctx, walCallback, tableNames, handlers)
+        return s.startJetStreamReplication(ctx, replication, messageHandler, batchHandler)
     }
     
-    return s.startDirectReplication(ctx, walCallback, tableNames)
+    return s.startDirectReplication(ctx, walCallback, replication)
 }
 
-func (s *Service) startJetStreamReplication(ctx context.Context, walCallback func([]byte), tableNames []string, handlers []*meilisearch.MeiliSearchHandler) error {
-    connector := &nat.URLConnector{URL: Url}
-    
-    nc, js, err := connector.Connect(true)
+// startJetStreamReplication only publishes WAL data from the replication loop;
+// Meilisearch is written by the consumers, so changes are applied once and at
+// the pace the consumers pull them. Either way there is one consumer on the
+// subject, and it hands every change to the handler of its table.
+func (s *Service) startJetStreamReplication(ctx context.Context, replication postgres.ReplicationConfig, messageHandler nat.MessageHandler, batchHandler nat.BatchMessageHandler) error {
+    nc, js, err := s.connect(ctx)
     if err != nil {
         return fmt.Errorf("failed to connect to NATS JetStream: %w", err)
     }
-    defer nc.Close()
+    go func() {
+        <-ctx.Done()
+        nc.Close()
+    }()
+    
+    // Setup subscriptions
+    subManager := &nat.SubscriptionManagerImpl{
+        JetStream:   js,
+        StreamName:  StreamName,
+        Checkpoints: replication.Checkpoints,
+    }
+    
+    if err := subManager.SetupStream(StreamName, Subject); err != nil {
+        return fmt.Errorf("failed to setup stream: %w", err)
+    }
     
     // Start WAL replication
-    go postgres.StartReplicationDatabase(ctx, js.(*nat.JetStreamContextImpl).JS, Subject, walCallback, tableNames, s.logger)
+    replication.Subject = Subject
+    replication.Format = EventFormat
+    go postgres.StartReplicationDatabase(ctx, js.(*nat.JetStreamContextImpl).JS, nil, replication, s.logger)
+    
+    if ConsumerMode == "pull" {
+        opts := nat.PullOptions{
+            BatchSize:     PullBatchSize,
+            MaxAckPending: PullMaxAckPending,
+            FetchTimeout:  PullFetchTimeout,
+        }
+        if err := subManager.PullSubscribeWithBatchHandler(ctx, Subject, DurableName, opts, batchHandler, s.logger); err != nil {
+            return fmt.Errorf("failed to pull subscribe with handler: %w", err)
+        }
+        return nil
+    }
+    
+    if err := subManager.SubscribeAsyncWithHandler(Subject, DurableName, messageHandler, s.logger); err != nil {
+        return fmt.Errorf("failed to subscribe with handler: %w", err)
+    }
+    
+    return nil
+}
+
+// Replay re-applies change events already stored in the stream, starting at
+// the sequence or time in opts, through handler. Postgres is not queried.
+func (s *Service) Replay(ctx context.Context, opts nat.ReplayOptions, handler nat.MessageHandler) error {
+    nc, js, err := s.connect(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to connect to NATS JetStream: %w", err)
+    }
+    defer nc.Close()
     
-    // Setup subscriptions
     subManager := &nat.SubscriptionManagerImpl{JetStream: js}
     
-    for _, handler := range handlers {
-        if err := subManager.SubscribeAsyncWithHandler(Subject, DurableName, handler, s.logger); err != nil {
-            return fmt.Errorf("failed to subscribe with handler: %w", err)
-        }
+    applied, err := subManager.Replay(ctx, Subject, opts, handler, s.logger)
+    if err != nil {
+        return fmt.Errorf("replay stopped after %d messages: %w", applied, err)
     }
     
+    s.logger.Printf("Replay applied %d messages", applied)
     return nil
 }
 
-func (s *Service) startDirectReplication(ctx context.Context, walCallback func([]byte), tableNames []string) error {
-    go postgres.StartReplicationDatabase(ctx, nil, "", walCallback, tableNames, s.logger)
+// connect dials NATS_URL, or starts the embedded server when NATS_EMBEDDED is
+// set. The embedded server shuts down with ctx. The connection is shared by
+// later calls.
+func (s *Service) connect(ctx context.Context) (nat.NATSConnection, nat.JetStreamContext, error) {
+    if s.js != nil {
+        return s.nc, s.js, nil
+    }
+    
+    var connector nat.NATSConnector = &nat.URLConnector{
+        URL:             Url,
+        CredsFile:       NatsCredsFile,
+        NKeyFile:        NatsNKeyFile,
+        User:            NatsUser,
+        Password:        NatsPassword,
+        Token:           NatsToken,
+        TLSCAFile:       NatsTLSCA,
+        TLSCertFile:     NatsTLSCert,
+        TLSKeyFile:      NatsTLSKey,
+        MaxReconnects:   NatsMaxReconnects,
+        ReconnectWait:   NatsReconnectWait,
+        ReconnectJitter: NatsReconnectJitter,
+        Logger:          s.logger,
+    }
+    
+    if NatsEmbedded {
+        ns, err := nat.StartEmbeddedServer(nat.EmbeddedServerOptions{
+            StoreDir: NatsStoreDir,
+            Port:     NatsEmbeddedPort,
+        }, s.logger)
+        if err != nil {
+            return nil, nil, err
+        }
+        go func() {
+            <-ctx.Done()
+            ns.Shutdown()
+        }()
+        connector = &nat.EmbeddedConnector{Server: ns}
+    }
+    
+    nc, js, err := connector.Connect(true)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    s.nc, s.js = nc, js
+    return nc, js, nil
+}
+
+func (s *Service) startDirectReplication(ctx context.Context, walCallback func([]byte), replication postgres.ReplicationConfig) error {
+    go postgres.StartReplicationDatabase(ctx, nil, walCallback, replication, s.logger)
     return nil
 }
\ No newline at end of file
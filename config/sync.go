@@ -1,9 +1,14 @@
 package config
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"nats-jetstream/pkg/checkpoint"
 	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/nat"
+	"nats-jetstream/pkg/postgres"
 
 	meili "github.com/meilisearch/meilisearch-go"
 )
@@ -11,16 +16,24 @@ import (
 type Manager struct {
     config       *ApplicationConfig
     database     *DatabaseStruct
+    checkpoints  checkpoint.Store
     handlers     []*meilisearch.MeiliSearchHandler
     walRouter    *Router
     logger       *log.Logger
+    // addedTables were just added to the publication and are backfilled in
+    // the background instead of during Initialize.
+    addedTables  map[string]bool
+    // watermark tracks the changes queued on the apply pool in direct mode,
+    // so the replication checkpoint stays below them.
+    watermark    *postgres.Watermark
 }
 
-func NewManager(cfg *ApplicationConfig, db *DatabaseStruct, logger *log.Logger) *Manager {
+func NewManager(cfg *ApplicationConfig, db *DatabaseStruct, checkpoints checkpoint.Store, logger *log.Logger) *Manager {
     return &Manager{
-        config:   cfg,
-        database: db,
-        logger:   logger,
+        config:      cfg,
+        database:    db,
+        checkpoints: checkpoints,
+        logger:      logger,
     }
 }
 
@@ -38,12 +51,35 @@ func (m *Manager) Initialize() error {
     return nil
 }
 
+// InitializeForReplay prepares the handlers and their indexes without
+// backfilling from the database.
+func (m *Manager) InitializeForReplay() error {
+    if err := m.setupMeiliSearchHandlers(); err != nil {
+        return fmt.Errorf("failed to setup MeiliSearch handlers: %w", err)
+    }
+    
+    for _, handler := range m.handlers {
+        if err := handler.CreateIndex(handler.Client, m.logger, handler.Index, handler.PK); err != nil {
+            return fmt.Errorf("failed to create index for table %s: %w", handler.TableName, err)
+        }
+    }
+    
+    m.setupWALRouter()
+    
+    return nil
+}
+
 func (m *Manager) setupMeiliSearchHandlers() error {
     client := meili.New(m.config.MeiliSearch.ApiUrl, meili.WithAPIKey(m.config.MeiliSearch.ApiKey))
     // // db, err := sql.Open("pgx", database)
 	// if err != nil {
 	// 	return fmt.Errorf("failed to open PostgreSQL with DSN: %w", err)
 	// }
+    var db *sql.DB
+    if m.database != nil {
+        db = m.database.DB
+    }
+    
     for _, syncCfg := range m.config.Sync {
         handler := &meilisearch.MeiliSearchHandler{
             Client:         client,
@@ -51,9 +87,23 @@ func (m *Manager) setupMeiliSearchHandlers() error {
             ApiKey:         m.config.MeiliSearch.ApiKey,
             TableName:      syncCfg.Table,
             Index:          syncCfg.Index,
-            PK:             syncCfg.PK,
-            DB:             m.database.DB,
+            PK:             syncCfg.DocumentID(),
+            KeyColumns:     syncCfg.PK,
+            IDStrategy:     syncCfg.IDStrategy,
+            DB:             db,
+            Checkpoints:    m.checkpoints,
             EnableInitData: m.config.Initialize,
+            Where:          syncCfg.Where,
+            Columns:        syncCfg.Columns,
+            SoftDelete:     syncCfg.SoftDelete.rule(),
+            Geo:            syncCfg.Geo.mapping(),
+            Vectors:        syncCfg.vectorMappings(),
+            WriteMode:      syncCfg.WriteMode,
+            IgnoreColumns:  syncCfg.IgnoreColumns,
+            HashCacheSize:  syncCfg.HashCacheSize,
+            CoalesceWindow: syncCfg.CoalesceWindow,
+            Toast:          syncCfg.Toast,
+            Logger:         m.logger,
         }
         m.handlers = append(m.handlers, handler)
     }
@@ -61,8 +111,47 @@ func (m *Manager) setupMeiliSearchHandlers() error {
     return nil
 }
 
+// ClaimSlot records this configuration as the owner of the replication slot
+// in the source database, failing if another configuration owns it.
+func (m *Manager) ClaimSlot(ctx context.Context) error {
+    if m.database == nil {
+        return fmt.Errorf("no database connection to claim the replication slot")
+    }
+    return postgres.ClaimSlot(ctx, m.database.DB, m.GetReplicationConfig())
+}
+
+// ReconcilePublication brings the publication in line with the configured
+// tables. It must run before Initialize, which backfills the tables it adds.
+// wal2json decodes every table whatever the publication says, so for this
+// sync the publication only marks which tables are new; it is kept accurate
+// for pgoutput consumers of the same publication.
+func (m *Manager) ReconcilePublication(ctx context.Context) error {
+    if m.database == nil {
+        return fmt.Errorf("no database connection to reconcile the publication")
+    }
+    
+    added, err := postgres.ReconcilePublication(ctx, m.database.DB, m.config.Replication.Publication, m.GetTableNames(), m.logger)
+    if err != nil {
+        return err
+    }
+    
+    m.addedTables = make(map[string]bool, len(added))
+    for _, table := range added {
+        m.addedTables[table] = true
+    }
+    return nil
+}
+
 func (m *Manager) initializeHandlers() error {
     for _, handler := range m.handlers {
+        if m.addedTables[handler.TableName] {
+            handler.PrepareIndex(m.logger)
+            if err := handler.ResetBackfill(); err != nil {
+                return fmt.Errorf("failed to reset backfill for table %s: %w", handler.TableName, err)
+            }
+            m.backfillAddedTable(handler)
+            continue
+        }
         if err := handler.InitializeData(m.logger); err != nil {
             return fmt.Errorf("failed to initialize handler for table %s: %w", handler.TableName, err)
         }
@@ -70,8 +159,26 @@ func (m *Manager) initializeHandlers() error {
     return nil
 }
 
+// backfillAddedTable copies a table that was just added to the publication.
+// It runs before streaming starts: the changes streamed afterwards, from the
+// slot's position on, are applied on top of the copy and bring every row to
+// its latest state, whereas a copy written concurrently could overwrite a
+// newer change with the row it read earlier.
+func (m *Manager) backfillAddedTable(handler *meilisearch.MeiliSearchHandler) {
+    m.logger.Printf("Backfilling table %s added to the publication", handler.TableName)
+    if err := handler.Backfill(m.logger); err != nil {
+        m.logger.Printf("Backfill of table %s failed, restart with initialize: true to resume it: %v", handler.TableName, err)
+    }
+}
+
 func (m *Manager) setupWALRouter() {
     m.walRouter = NewRouter(m.handlers, m.logger)
+    if StreamService != "jetstream" {
+        m.watermark = &postgres.Watermark{}
+        pool := meilisearch.NewApplyPool(ApplyWorkers, ApplyQueueDepth, m.watermark, m.logger)
+        m.walRouter.UsePool(pool)
+        m.logger.Printf("Applying changes on %d workers", pool.Workers())
+    }
 }
 
 func (m *Manager) GetTableNames() []string {
@@ -82,10 +189,58 @@ func (m *Manager) GetTableNames() []string {
     return tableNames
 }
 
+// partitionResolver maps partitions to their parent table, so sync entries
+// naming a partitioned table receive the changes of every partition. It
+// needs pg_partition_root from Postgres 12.
+func (m *Manager) partitionResolver() *postgres.PartitionResolver {
+    if m.database == nil {
+        return nil
+    }
+    var version int
+    if err := m.database.DB.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+        m.logger.Printf("Failed to read server version, partitions are not mapped to their parent: %v", err)
+        return nil
+    }
+    if version < 120000 {
+        return nil
+    }
+    return postgres.NewPartitionResolver(m.database.DB)
+}
+
+// GetReplicationConfig returns the tables to replicate together with their
+// configured primary keys.
+func (m *Manager) GetReplicationConfig() postgres.ReplicationConfig {
+    primaryKeys := make(map[string][]string)
+    for _, syncCfg := range m.config.Sync {
+        if len(syncCfg.PK) > 0 {
+            primaryKeys[postgres.ParseTableName(syncCfg.Table).String()] = syncCfg.PK
+        }
+    }
+    
+    return postgres.ReplicationConfig{
+        SlotName:        m.config.Replication.Slot,
+        Publication:     m.config.Replication.Publication,
+        ApplicationName: m.config.Replication.ApplicationName,
+        Tables:          m.GetTableNames(),
+        PrimaryKeys:     primaryKeys,
+        Checkpoints:     m.checkpoints,
+        Partitions:      m.partitionResolver(),
+        Watermark:       m.watermark,
+    }
+}
+
 func (m *Manager) GetWALCallback() func([]byte) {
     return m.walRouter.GetCallback()
 }
 
 func (m *Manager) GetHandlers() []*meilisearch.MeiliSearchHandler {
     return m.handlers
+}
+
+func (m *Manager) GetBatchHandler() nat.BatchMessageHandler {
+    return m.walRouter
+}
+
+func (m *Manager) GetMessageHandler() nat.MessageHandler {
+    return m.walRouter
 }
\ No newline at end of file
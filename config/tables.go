@@ -0,0 +1,288 @@
+package config
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "log"
+    "slices"
+    "strings"
+
+    "nats-jetstream/pkg/checkpoint"
+    "nats-jetstream/pkg/meilisearch"
+    "nats-jetstream/pkg/postgres"
+)
+
+// HasWildcards reports whether any sync entry names its tables with a
+// pattern such as "catalog.*".
+func HasWildcards(entries []SyncConfig) bool {
+    for _, entry := range entries {
+        if strings.Contains(entry.Table, "*") {
+            return true
+        }
+    }
+    return false
+}
+
+// ExpandSync replaces every wildcard entry with one entry per matching table.
+// "*" in the table part matches any characters; the schema must be given
+// literally. The index name of a wildcard entry must contain {table} (and
+// may contain {schema}) so every table gets its own index. Tables listed
+// explicitly keep their own entry.
+func ExpandSync(ctx context.Context, db *sql.DB, entries []SyncConfig) ([]SyncConfig, error) {
+    if !HasWildcards(entries) {
+        return entries, nil
+    }
+    if db == nil {
+        return nil, fmt.Errorf("expanding table patterns needs a database connection")
+    }
+    
+    explicit := make(map[string]bool)
+    for _, entry := range entries {
+        if !strings.Contains(entry.Table, "*") {
+            explicit[postgres.ParseTableName(entry.Table).String()] = true
+        }
+    }
+    
+    var expanded []SyncConfig
+    for _, entry := range entries {
+        if !strings.Contains(entry.Table, "*") {
+            expanded = append(expanded, entry)
+            continue
+        }
+        
+        if !strings.Contains(entry.Index, "{table}") {
+            return nil, fmt.Errorf("index %q of table pattern %s must contain {table}", entry.Index, entry.Table)
+        }
+        
+        pattern := postgres.ParseTableName(entry.Table)
+        tables, err := matchTables(ctx, db, pattern)
+        if err != nil {
+            return nil, err
+        }
+        if len(tables) == 0 {
+            return nil, fmt.Errorf("table pattern %s matches no tables", entry.Table)
+        }
+        
+        for _, table := range tables {
+            if explicit[table.String()] {
+                continue
+            }
+            match := entry
+            match.Table = table.String()
+            match.Index = strings.NewReplacer("{schema}", table.Schema, "{table}", table.Name).Replace(entry.Index)
+            expanded = append(expanded, match)
+        }
+    }
+    
+    return expanded, nil
+}
+
+func matchTables(ctx context.Context, db *sql.DB, pattern postgres.TableName) ([]postgres.TableName, error) {
+    like := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%").Replace(pattern.Name)
+    
+    rows, err := db.QueryContext(ctx, `SELECT c.relname
+        FROM pg_class c
+        JOIN pg_namespace n ON n.oid = c.relnamespace
+        WHERE n.nspname = $1 AND c.relname LIKE $2 AND c.relkind IN ('r', 'p')
+            AND NOT c.relispartition AND c.relname <> $3
+        ORDER BY c.relname`, pattern.Schema, like, checkpoint.PostgresTable)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list tables matching %s: %w", pattern, err)
+    }
+    defer rows.Close()
+    
+    var tables []postgres.TableName
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        tables = append(tables, postgres.TableName{Schema: pattern.Schema, Name: name})
+    }
+    return tables, rows.Err()
+}
+
+// ResolvePrimaryKeys fills in the pk of entries that leave it out from the
+// table's primary key and checks configured keys against the catalog, so a
+// typo fails at startup instead of breaking deletes later.
+func ResolvePrimaryKeys(ctx context.Context, db *sql.DB, entries []SyncConfig, l *log.Logger) ([]SyncConfig, error) {
+    resolved := make([]SyncConfig, len(entries))
+    for i, entry := range entries {
+        pk, err := resolvePrimaryKey(ctx, db, entry)
+        if err != nil {
+            return nil, err
+        }
+        if len(entry.PK) == 0 {
+            l.Printf("Using primary key (%s) of table %s", pk, entry.Table)
+        }
+        entry.PK = pk
+        if err := checkIndexColumns(ctx, db, entry); err != nil {
+            return nil, err
+        }
+        resolved[i] = entry
+    }
+    return resolved, nil
+}
+
+// HasMissingKeys reports whether an entry needs its pk looked up.
+func HasMissingKeys(entries []SyncConfig) bool {
+    for _, entry := range entries {
+        if len(entry.PK) == 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// HasRowFilters reports whether an entry filters its rows, which is checked
+// against the database.
+func HasRowFilters(entries []SyncConfig) bool {
+    for _, entry := range entries {
+        if entry.Where != "" {
+            return true
+        }
+    }
+    return false
+}
+
+func resolvePrimaryKey(ctx context.Context, db *sql.DB, entry SyncConfig) (KeyColumns, error) {
+    table := postgres.ParseTableName(entry.Table)
+    columns, err := primaryKeyColumns(ctx, db, table)
+    if err != nil {
+        return nil, err
+    }
+    
+    switch {
+    case len(columns) > 0 && len(entry.PK) == 0:
+        return columns, nil
+    case len(columns) > 0 && !sameColumns(entry.PK, columns):
+        return nil, fmt.Errorf("pk (%s) of table %s does not match its primary key (%s)", entry.PK, table, strings.Join(columns, ", "))
+    case len(columns) > 0:
+        // Keep the configured order, it defines the document id.
+        return entry.PK, nil
+    case len(entry.PK) == 0:
+        return nil, fmt.Errorf("table %s has no primary key; set pk to unique, non-null columns", table)
+    }
+    
+    // Without a primary key, the configured columns must at least form a
+    // unique index.
+    sorted := slices.Clone([]string(entry.PK))
+    slices.Sort(sorted)
+    var unique bool
+    err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1
+        FROM pg_index i
+        WHERE i.indrelid = to_regclass($1) AND i.indisunique AND i.indpred IS NULL AND i.indnkeyatts = $2
+            AND (SELECT array_agg(a.attname::text ORDER BY a.attname::text)
+                FROM pg_attribute a
+                WHERE a.attrelid = i.indrelid AND a.attnum = ANY (i.indkey[0:i.indnkeyatts - 1])) = $3::text[])`,
+        table.Sanitize(), len(sorted), sorted).Scan(&unique)
+    if err != nil {
+        return nil, fmt.Errorf("failed to check pk of table %s: %w", table, err)
+    }
+    if !unique {
+        return nil, fmt.Errorf("table %s has no primary key and pk (%s) is not unique", table, entry.PK)
+    }
+    return entry.PK, nil
+}
+
+// checkIndexColumns requires the columns of an index template such as
+// products_{tenant_id} to be part of the table's replica identity, so
+// updates and deletes carry them in the old row whenever they changed and
+// the index holding a row's document is always known. They need not be part
+// of pk: REPLICA IDENTITY FULL sends every column.
+func checkIndexColumns(ctx context.Context, db *sql.DB, entry SyncConfig) error {
+    columns := meilisearch.IndexColumns(entry.Index)
+    if len(columns) == 0 {
+        return nil
+    }
+    table := postgres.ParseTableName(entry.Table)
+    identity, full, err := replicaIdentityColumns(ctx, db, table)
+    if err != nil || full {
+        return err
+    }
+    for _, column := range columns {
+        if !slices.Contains(identity, column) {
+            return fmt.Errorf("table %s: column %s of index %q must be part of the replica identity, the primary key by default; set REPLICA IDENTITY FULL on the table to use other columns", table, column, entry.Index)
+        }
+    }
+    return nil
+}
+
+// replicaIdentityColumns returns the columns Postgres sends in the old row of
+// updates and deletes of table. full is true with REPLICA IDENTITY FULL,
+// which sends every column.
+func replicaIdentityColumns(ctx context.Context, db *sql.DB, table postgres.TableName) (columns []string, full bool, err error) {
+    var identity string
+    if err := db.QueryRowContext(ctx, "SELECT relreplident::text FROM pg_class WHERE oid = to_regclass($1)", table.Sanitize()).Scan(&identity); err != nil {
+        return nil, false, fmt.Errorf("failed to look up replica identity of table %s: %w", table, err)
+    }
+    switch identity {
+    case "f":
+        return nil, true, nil
+    case "n":
+        return nil, false, nil
+    }
+    
+    rows, err := db.QueryContext(ctx, `SELECT a.attname
+        FROM pg_index i
+        JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY (i.indkey)
+        WHERE i.indrelid = to_regclass($1) AND CASE WHEN $2 = 'i' THEN i.indisreplident ELSE i.indisprimary END`,
+        table.Sanitize(), identity)
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to look up replica identity of table %s: %w", table, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var column string
+        if err := rows.Scan(&column); err != nil {
+            return nil, false, err
+        }
+        columns = append(columns, column)
+    }
+    return columns, false, rows.Err()
+}
+
+func sameColumns(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for _, column := range a {
+        if !slices.Contains(b, column) {
+            return false
+        }
+    }
+    return true
+}
+
+// primaryKeyColumns returns the primary key columns of a table in key order.
+func primaryKeyColumns(ctx context.Context, db *sql.DB, table postgres.TableName) ([]string, error) {
+    var exists bool
+    if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table.Sanitize()).Scan(&exists); err != nil {
+        return nil, fmt.Errorf("failed to look up table %s: %w", table, err)
+    }
+    if !exists {
+        return nil, fmt.Errorf("table %s does not exist", table)
+    }
+    
+    rows, err := db.QueryContext(ctx, `SELECT a.attname
+        FROM pg_constraint c
+        CROSS JOIN LATERAL unnest(c.conkey) WITH ORDINALITY AS k(attnum, ord)
+        JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+        WHERE c.conrelid = to_regclass($1) AND c.contype = 'p'
+        ORDER BY k.ord`, table.Sanitize())
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up primary key of %s: %w", table, err)
+    }
+    defer rows.Close()
+    
+    var columns []string
+    for rows.Next() {
+        var column string
+        if err := rows.Scan(&column); err != nil {
+            return nil, err
+        }
+        columns = append(columns, column)
+    }
+    return columns, rows.Err()
+}
@@ -1,38 +1,71 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 
 	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
 )
 
 type Router struct {
     callbackMap map[string]func([]byte)
+    handlers    map[string]*meilisearch.MeiliSearchHandler
     logger      *log.Logger
+    // pool, when set, applies the changes of HandleWALData in parallel.
+    pool        *meilisearch.ApplyPool
 }
 
 type WALMessage struct {
-    Change []struct {
-        Table string `json:"table"`
-    } `json:"change"`
+    Table string `json:"table"`
 }
 
 func NewRouter(handlers []*meilisearch.MeiliSearchHandler, logger *log.Logger) *Router {
     callbackMap := make(map[string]func([]byte))
+    handlerMap := make(map[string]*meilisearch.MeiliSearchHandler)
     
     for _, handler := range handlers {
-        callbackMap[handler.TableName] = handler.CreateWALCallback(logger)
+        callbackMap[handler.QualifiedTable()] = handler.CreateWALCallback(logger)
+        handlerMap[handler.QualifiedTable()] = handler
     }
     
     return &Router{
         callbackMap: callbackMap,
+        handlers:    handlerMap,
         logger:      logger,
     }
 }
 
+// HandleMessage routes a single change event to its table's handler and
+// reports the handler's error, unlike the fire-and-forget WAL callback.
+func (r *Router) HandleMessage(data []byte, l *log.Logger) error {
+    tableName, err := r.parseTableName(data)
+    if err != nil {
+        return fmt.Errorf("failed to parse WAL message: %w", err)
+    }
+    
+    handler, exists := r.handlers[tableName]
+    if !exists {
+        l.Printf("No handler found for table: %s", tableName)
+        return nil
+    }
+    
+    return handler.HandleMessage(data, l)
+}
+
+// UsePool makes HandleWALData queue changes on pool instead of applying
+// them before it returns.
+func (r *Router) UsePool(pool *meilisearch.ApplyPool) {
+    r.pool = pool
+}
+
 func (r *Router) HandleWALData(data []byte) {
+    if r.pool != nil {
+        r.submit(data)
+        return
+    }
+    
     tableName, err := r.parseTableName(data)
     if err != nil {
         r.logger.Printf("Failed to parse WAL message: %v", err)
@@ -47,18 +80,113 @@ func (r *Router) HandleWALData(data []byte) {
     }
 }
 
-func (r *Router) parseTableName(data []byte) (string, error) {
-    var walMessage WALMessage
+// submit queues a change on the pool for its table's handler.
+func (r *Router) submit(data []byte) {
+    change, err := postgres.DecodeEvent(data)
+    if err != nil {
+        r.logger.Printf("Failed to parse WAL message: %v", err)
+        return
+    }
+    
+    handler, exists := r.handlers[change.QualifiedTable()]
+    if !exists {
+        r.logger.Printf("No handler found for table: %s", change.QualifiedTable())
+        return
+    }
+    r.pool.Submit(handler, change)
+}
+
+// HandleBatch routes every change of a fetched batch to its table's handler,
+// keeping commit order per table, so each handler writes the batch as a few
+// bulk requests instead of one request per message. It returns once the
+// whole batch is written, waiting out the coalescing windows of its tables.
+func (r *Router) HandleBatch(batch [][]byte, l *log.Logger) error {
+    result := make(chan error, 1)
+    r.HandleBatchDeferred(batch, l, func(err error) { result <- err })
+    return <-result
+}
+
+// HandleBatchDeferred routes a batch like HandleBatch, but returns as soon as
+// the tables without a coalescing window are written. done is called once
+// the changes held for a window are written too, so the pull consumer keeps
+// fetching, and more changes reach the window, in the meantime.
+func (r *Router) HandleBatchDeferred(batch [][]byte, l *log.Logger, done func(error)) {
+    var tables []string
+    changesByTable := make(map[string][]postgres.ChangeEvent)
+    
+    for _, data := range batch {
+        change, err := postgres.DecodeEvent(data)
+        if err != nil {
+            l.Printf("Failed to parse WAL message: %v", err)
+            continue
+        }
+        
+        table := change.QualifiedTable()
+        if _, exists := r.handlers[table]; !exists {
+            l.Printf("No handler found for table: %s", table)
+            continue
+        }
+        if _, seen := changesByTable[table]; !seen {
+            tables = append(tables, table)
+        }
+        changesByTable[table] = append(changesByTable[table], change)
+    }
     
-    if err := json.Unmarshal(data, &walMessage); err != nil {
+    result := newBatchResult(len(tables), done)
+    for _, table := range tables {
+        changes := changesByTable[table]
+        l.Printf("Routing batch of %d changes to handler for table: %s", len(changes), table)
+        r.handlers[table].Coalesce(changes, func(err error) {
+            if err != nil {
+                err = fmt.Errorf("failed to process batch for table %s: %w", table, err)
+            }
+            result.finish(err)
+        })
+    }
+}
+
+// batchResult calls done once every table of a batch finished, with the
+// first error reported.
+type batchResult struct {
+    mu        sync.Mutex
+    remaining int
+    err       error
+    done      func(error)
+}
+
+func newBatchResult(tables int, done func(error)) *batchResult {
+    if tables == 0 {
+        done(nil)
+    }
+    return &batchResult{remaining: tables, done: done}
+}
+
+func (b *batchResult) finish(err error) {
+    b.mu.Lock()
+    if b.err == nil {
+        b.err = err
+    }
+    b.remaining--
+    last := b.remaining == 0
+    b.mu.Unlock()
+    
+    if last {
+        b.done(b.err)
+    }
+}
+
+// parseTableName returns the schema.table a change event belongs to.
+func (r *Router) parseTableName(data []byte) (string, error) {
+    change, err := postgres.DecodeEvent(data)
+    if err != nil {
         return "", err
     }
     
-    if len(walMessage.Change) == 0 {
-        return "", fmt.Errorf("no changes found in WAL message")
+    if change.Table == "" {
+        return "", fmt.Errorf("no table found in WAL message")
     }
     
-    return walMessage.Change[0].Table, nil
+    return change.QualifiedTable(), nil
 }
 
 func (r *Router) GetCallback() func([]byte) {
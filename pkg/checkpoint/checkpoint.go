@@ -0,0 +1,43 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+)
+
+// Store persists progress markers so replication, backfill and consumers can
+// resume where they stopped.
+type Store interface {
+	// Load returns the value saved under key and whether one exists.
+	Load(ctx context.Context, key string) (string, bool, error)
+	Save(ctx context.Context, key, value string) error
+}
+
+// BackfillDone is saved as the backfill cursor once a table is fully copied.
+const BackfillDone = "done"
+
+// ReplicationKey holds the last WAL position confirmed for a slot.
+func ReplicationKey(slot string) string {
+	return fmt.Sprintf("replication.%s.lsn", slot)
+}
+
+// SlotOwnerKey identifies the configuration that created a slot, so another
+// deployment cannot take it over by accident.
+func SlotOwnerKey(slot string) string {
+	return fmt.Sprintf("replication.%s.owner", slot)
+}
+
+// BackfillKey holds the backfill cursor of a table.
+func BackfillKey(table string) string {
+	return fmt.Sprintf("backfill.%s", table)
+}
+
+// ConsumerKey holds the last stream sequence applied by a durable consumer.
+func ConsumerKey(durable string) string {
+	return fmt.Sprintf("consumer.%s.sequence", durable)
+}
+
+// TaskKey holds the uid of the last Meilisearch task enqueued for an index.
+func TaskKey(index string) string {
+	return fmt.Sprintf("meilisearch.%s.task", index)
+}
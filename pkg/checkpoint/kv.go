@@ -0,0 +1,48 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KVStore keeps checkpoints in a JetStream key-value bucket.
+type KVStore struct {
+	KV nats.KeyValue
+}
+
+// NewKVStore binds to bucket, creating it when it does not exist yet.
+func NewKVStore(js nats.JetStreamContext, bucket string) (*KVStore, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			Storage: nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind checkpoint bucket %s: %w", bucket, err)
+	}
+
+	return &KVStore{KV: kv}, nil
+}
+
+func (s *KVStore) Load(_ context.Context, key string) (string, bool, error) {
+	entry, err := s.KV.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load checkpoint %s: %w", key, err)
+	}
+	return string(entry.Value()), true, nil
+}
+
+func (s *KVStore) Save(_ context.Context, key, value string) error {
+	if _, err := s.KV.PutString(key, value); err != nil {
+		return fmt.Errorf("failed to save checkpoint %s: %w", key, err)
+	}
+	return nil
+}
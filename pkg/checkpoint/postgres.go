@@ -0,0 +1,52 @@
+package checkpoint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// PostgresTable is the table created by NewPostgresStore.
+const PostgresTable = "syncmeili_checkpoints"
+
+// PostgresStore keeps checkpoints in the syncmeili_checkpoints table of the
+// source database.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(ctx context.Context, db *sql.DB) (*PostgresStore, error) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS syncmeili_checkpoints (
+		key        text PRIMARY KEY,
+		value      text NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create syncmeili_checkpoints table: %w", err)
+	}
+
+	return &PostgresStore{DB: db}, nil
+}
+
+func (s *PostgresStore) Load(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := s.DB.QueryRowContext(ctx, "SELECT value FROM syncmeili_checkpoints WHERE key = $1", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load checkpoint %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (s *PostgresStore) Save(ctx context.Context, key, value string) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO syncmeili_checkpoints (key, value, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package meilisearch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"nats-jetstream/pkg/checkpoint"
+)
+
+const (
+	backfillPageSize = 1000
+	cursorColumn     = "syncmeili_cursor"
+	// taskSaveInterval limits how often the last task uid is written to the
+	// checkpoint store.
+	taskSaveInterval = time.Second
+)
+
+func (m *MeiliSearchHandler) loadBackfillCursor() (string, error) {
+	if m.Checkpoints == nil {
+		return "", nil
+	}
+	cursor, _, err := m.Checkpoints.Load(context.Background(), checkpoint.BackfillKey(m.TableName))
+	if err != nil {
+		return "", fmt.Errorf("failed to load backfill checkpoint: %w", err)
+	}
+	return cursor, nil
+}
+
+func (m *MeiliSearchHandler) saveBackfillCursor(cursor string) error {
+	if m.Checkpoints == nil {
+		return nil
+	}
+	if err := m.Checkpoints.Save(context.Background(), checkpoint.BackfillKey(m.TableName), cursor); err != nil {
+		return fmt.Errorf("failed to save backfill checkpoint: %w", err)
+	}
+	return nil
+}
+
+// saveTask records the uid of the last task enqueued for the index. Writes
+// run in parallel on the apply workers and their responses arrive in any
+// order, so only a uid above the highest one seen is kept. It is saved at
+// most once per taskSaveInterval: a uid arriving sooner is saved by a timer
+// when the interval is over, together with any newer one by then.
+func (m *MeiliSearchHandler) saveTask(uid int64, l *log.Logger) {
+	if m.Checkpoints == nil {
+		return
+	}
+	m.taskMu.Lock()
+	defer m.taskMu.Unlock()
+	if uid <= m.lastTask {
+		return
+	}
+	m.lastTask = uid
+	if m.taskTimer != nil {
+		return
+	}
+	if wait := taskSaveInterval - time.Since(m.taskSaved); wait > 0 {
+		m.taskTimer = time.AfterFunc(wait, func() {
+			m.taskMu.Lock()
+			defer m.taskMu.Unlock()
+			m.taskTimer = nil
+			m.writeTask(l)
+		})
+		return
+	}
+	m.writeTask(l)
+}
+
+// writeTask saves the highest task uid seen. taskMu must be held.
+func (m *MeiliSearchHandler) writeTask(l *log.Logger) {
+	m.taskSaved = time.Now()
+	if err := m.Checkpoints.Save(context.Background(), checkpoint.TaskKey(m.Index), strconv.FormatInt(m.lastTask, 10)); err != nil {
+		l.Printf("Failed to save task checkpoint for index %s: %v", m.Index, err)
+	}
+}
+
+// restoreLastTask reports how the last task enqueued before a restart ended,
+// so a write that failed while the process was down does not go unnoticed.
+func (m *MeiliSearchHandler) restoreLastTask(l *log.Logger) {
+	if m.Checkpoints == nil {
+		return
+	}
+
+	value, ok, err := m.Checkpoints.Load(context.Background(), checkpoint.TaskKey(m.Index))
+	if err != nil || !ok {
+		return
+	}
+
+	uid, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		l.Printf("Invalid task checkpoint %q for index %s", value, m.Index)
+		return
+	}
+
+	task, err := m.Client.GetTask(uid)
+	if err != nil {
+		l.Printf("Failed to get last task %d of index %s: %v", uid, m.Index, err)
+		return
+	}
+
+	if task.Error.Code != "" {
+		l.Printf("Last task %d of index %s %s: %s", uid, m.Index, task.Status, task.Error.Message)
+		return
+	}
+	l.Printf("Last task %d of index %s is %s", uid, m.Index, task.Status)
+}
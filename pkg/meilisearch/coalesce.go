@@ -0,0 +1,195 @@
+package meilisearch
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"nats-jetstream/pkg/postgres"
+)
+
+// coalesce collapses the changes of each document into one, placed where
+// the document's last change was, so changes to different documents keep
+// their commit order. Successive upserts merge their rows, the later values
+// winning, which keeps columns a later update left out because they were
+// unchanged. A delete replaces what came before it, an insert followed by a
+// delete cancels out, and a delete followed by an insert is an update. The
+// first old row is kept, so the result can be compared with, and routed
+// from, the state before the window.
+func (m *MeiliSearchHandler) coalesce(changes []postgres.ChangeEvent) []postgres.ChangeEvent {
+	type slot struct {
+		change postgres.ChangeEvent
+		// inserted is set when the document did not exist before its first
+		// change in the window.
+		inserted bool
+	}
+
+	slots := make([]*slot, 0, len(changes))
+	last := make(map[string]int, len(changes))
+	for _, change := range changes {
+		values, err := keyValues(m.keyColumns(), change.PK, change.Before, change.After)
+		if err != nil {
+			slots = append(slots, &slot{change: change})
+			continue
+		}
+		key := EncodeDocumentID(values)
+
+		i, seen := last[key]
+		if !seen {
+			last[key] = len(slots)
+			slots = append(slots, &slot{change: change, inserted: change.Op == "insert"})
+			continue
+		}
+
+		prev := slots[i]
+		slots[i] = nil
+		next := &slot{change: change, inserted: prev.inserted}
+		switch change.Op {
+		case "delete":
+			if prev.inserted {
+				delete(last, key)
+				continue
+			}
+		case "insert":
+			// The document the delete would have removed is still there, so
+			// the insert replaces it like an update would, and is not
+			// dropped if the new row is filtered out.
+			if prev.change.Op == "delete" {
+				next.change.Op = "update"
+				next.change.Before = prev.change.Before
+			}
+		case "update":
+			if prev.change.Op == "insert" || prev.change.Op == "update" {
+				next.change.Op = prev.change.Op
+				next.change.Before = prev.change.Before
+				next.change.After = merged(prev.change.After, change.After)
+				next.change.Types = merged(prev.change.Types, change.Types)
+			}
+		}
+		last[key] = len(slots)
+		slots = append(slots, next)
+	}
+
+	coalesced := make([]postgres.ChangeEvent, 0, len(last))
+	for _, s := range slots {
+		if s != nil {
+			coalesced = append(coalesced, s.change)
+		}
+	}
+	return coalesced
+}
+
+// merged returns a copy of base updated with the entries of update.
+func merged[V any](base, update map[string]V) map[string]V {
+	result := make(map[string]V, len(base)+len(update))
+	maps.Copy(result, base)
+	maps.Copy(result, update)
+	return result
+}
+
+// Backoff between retries of a write that must not be given up.
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// coalescer holds a table's changes for CoalesceWindow and writes them as
+// one coalesced batch.
+type coalescer struct {
+	mu      sync.Mutex
+	pending []postgres.ChangeEvent
+	// taken is signalled when a flush takes the pending changes.
+	taken   *sync.Cond
+	waiters []func(error)
+	timer   *time.Timer
+	// retry is set when a waiter needs the batch retried until it is written.
+	retry *log.Logger
+
+	// flushMu keeps flushes in order.
+	flushMu sync.Mutex
+}
+
+// Coalesce writes changes and reports the outcome through done. With a
+// CoalesceWindow the changes are held until the window, started by the
+// first change held, ends; changes to the same document arriving meanwhile
+// are collapsed into their last state. Without one they are written before
+// Coalesce returns.
+func (m *MeiliSearchHandler) Coalesce(changes []postgres.ChangeEvent, done func(error)) {
+	m.hold(changes, done, 0, nil)
+}
+
+// CoalesceUntilApplied is Coalesce for callers that cannot have changes
+// delivered again. A failed write is logged to l and retried with backoff
+// until it succeeds, before any later change of the table is written, so
+// done is only called once the changes are in the index. While limit or more
+// changes are held, it blocks until a flush takes them, so a retried write
+// holds back the caller instead of letting the held changes grow.
+func (m *MeiliSearchHandler) CoalesceUntilApplied(changes []postgres.ChangeEvent, done func(error), limit int, l *log.Logger) {
+	m.hold(changes, done, limit, l)
+}
+
+func (m *MeiliSearchHandler) hold(changes []postgres.ChangeEvent, done func(error), limit int, retry *log.Logger) {
+	if m.CoalesceWindow <= 0 {
+		done(m.write(changes, retry))
+		return
+	}
+
+	c := m.changeCoalescer()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for limit > 0 && len(c.pending) >= limit {
+		c.taken.Wait()
+	}
+	c.pending = append(c.pending, changes...)
+	c.waiters = append(c.waiters, done)
+	if retry != nil {
+		c.retry = retry
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(m.CoalesceWindow, func() { m.flushCoalesced(c) })
+	}
+}
+
+func (m *MeiliSearchHandler) changeCoalescer() *coalescer {
+	m.coalescerOnce.Do(func() {
+		m.coalescer = &coalescer{}
+		m.coalescer.taken = sync.NewCond(&m.coalescer.mu)
+	})
+	return m.coalescer
+}
+
+// flushCoalesced writes the held changes and tells every waiter the outcome.
+func (m *MeiliSearchHandler) flushCoalesced(c *coalescer) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	changes, waiters, retry := c.pending, c.waiters, c.retry
+	c.pending, c.waiters, c.timer, c.retry = nil, nil, nil, nil
+	c.taken.Broadcast()
+	c.mu.Unlock()
+
+	if len(waiters) == 0 {
+		return
+	}
+	err := m.write(m.coalesce(changes), retry)
+	for _, done := range waiters {
+		done(err)
+	}
+}
+
+// write applies changes. With retry set, a failure is logged there and the
+// write repeated until it succeeds.
+func (m *MeiliSearchHandler) write(changes []postgres.ChangeEvent, retry *log.Logger) error {
+	backoff := minRetryBackoff
+	for {
+		err := m.ProcessChanges(changes)
+		if err == nil || retry == nil {
+			return err
+		}
+		retry.Printf("Failed to apply %d changes to table %s, retrying in %s: %v", len(changes), m.TableName, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,192 @@
+package meilisearch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// applyFilter enforces the table's row filter, soft-delete rule, column
+// list and ignored columns on a change. wal2json streams every row and
+// column regardless of the publication, so they are evaluated here; matches
+// is the outcome of the row filter from filterMatches. An update whose row
+// does not match the filter, or is soft-deleted, becomes a delete; a row
+// that matches again is upserted, which restores its document. Such an
+// insert has no document to remove, so ok is false and it is dropped.
+func (m *MeiliSearchHandler) applyFilter(change postgres.ChangeEvent, matches bool) (filtered postgres.ChangeEvent, ok bool) {
+	if change.Op != "insert" && change.Op != "update" {
+		return change, true
+	}
+
+	if !matches || (m.SoftDelete != nil && m.SoftDelete.Deleted(change.After)) {
+		if change.Op == "insert" {
+			return change, false
+		}
+		return m.asDelete(change), true
+	}
+
+	if len(m.Columns) > 0 {
+		after := make(map[string]interface{}, len(m.Columns)+len(m.keyColumns()))
+		for _, column := range append(m.keyColumns(), m.projectedColumns()...) {
+			if value, ok := change.After[column]; ok {
+				after[column] = value
+			}
+		}
+		change.After = after
+	}
+
+	if len(m.IgnoreColumns) > 0 {
+		after := make(map[string]interface{}, len(change.After))
+		for column, value := range change.After {
+			if !slices.Contains(m.IgnoreColumns, column) {
+				after[column] = value
+			}
+		}
+		change.After = after
+	}
+
+	return change, true
+}
+
+// projectedColumns returns the configured column list plus the columns the
+// document is derived from, such as the geo and vector source columns.
+func (m *MeiliSearchHandler) projectedColumns() []string {
+	var derived []string
+	if m.Geo != nil {
+		derived = append(derived, m.Geo.columns()...)
+	}
+	for _, mapping := range m.Vectors {
+		derived = append(derived, mapping.Column)
+	}
+	derived = append(derived, IndexColumns(m.Index)...)
+	if len(derived) == 0 {
+		return m.Columns
+	}
+	columns := append([]string{}, m.Columns...)
+	for _, column := range derived {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// asDelete turns an upsert into a delete of the row's document.
+func (m *MeiliSearchHandler) asDelete(change postgres.ChangeEvent) postgres.ChangeEvent {
+	change.Op = "delete"
+	if change.PK == nil {
+		change.PK = make(map[string]interface{})
+		for _, column := range m.keyColumns() {
+			change.PK[column] = change.After[column]
+		}
+	}
+	return change
+}
+
+// maxFilterArgs keeps a filter query below the 65535 bind parameters
+// Postgres accepts.
+const maxFilterArgs = 60000
+
+// filterMatches evaluates the where expression against the new row of every
+// insert and update, reporting for each change whether it matches. The rows
+// are bound as one-row derived tables, so the expression sees the same
+// column names and types it would see on the table, and evaluated together
+// in one round-trip per query of up to maxFilterArgs values. Without a
+// filter, and for deletes, every change matches.
+func (m *MeiliSearchHandler) filterMatches(changes []postgres.ChangeEvent) ([]bool, error) {
+	matches := make([]bool, len(changes))
+	var pending []int
+	for i, change := range changes {
+		if m.Where == "" || (change.Op != "insert" && change.Op != "update") {
+			matches[i] = true
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return matches, nil
+	}
+	if m.DB == nil {
+		return nil, fmt.Errorf("row filter of %s needs a database connection", m.TableName)
+	}
+
+	var selects []string
+	var args []interface{}
+	flush := func() error {
+		if len(selects) == 0 {
+			return nil
+		}
+		rows, err := m.DB.Query(strings.Join(selects, " UNION ALL "), args...)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate row filter of %s: %w", m.TableName, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var i int
+			var match sql.NullBool
+			if err := rows.Scan(&i, &match); err != nil {
+				return fmt.Errorf("failed to evaluate row filter of %s: %w", m.TableName, err)
+			}
+			matches[i] = match.Valid && match.Bool
+		}
+		selects, args = selects[:0], args[:0]
+		return rows.Err()
+	}
+
+	for _, i := range pending {
+		change := changes[i]
+		if len(args)+len(change.After) > maxFilterArgs {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		columns := make([]string, 0, len(change.After))
+		for column, value := range change.After {
+			pgType := change.Types[column]
+			if pgType == "" {
+				pgType = "text"
+			}
+			text, err := filterArg(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to bind column %s: %w", column, err)
+			}
+			args = append(args, text)
+			columns = append(columns, fmt.Sprintf("$%d::text::%s AS %s", len(args), pgType, pgx.Identifier{column}.Sanitize()))
+		}
+		selects = append(selects, fmt.Sprintf("SELECT %d, (%s) FROM (SELECT %s) AS t", i, m.Where, strings.Join(columns, ", ")))
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// filterArg converts a decoded column value back to its Postgres text form.
+func filterArg(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+}
@@ -0,0 +1,228 @@
+package meilisearch
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	meili "github.com/meilisearch/meilisearch-go"
+)
+
+// GeoField is the attribute Meilisearch reads coordinates from.
+const GeoField = "_geo"
+
+// GeoMapping builds the _geo attribute of a document, either from two
+// numeric columns (Lat and Lng) or from a PostGIS point Column.
+type GeoMapping struct {
+	Lat    string
+	Lng    string
+	Column string
+}
+
+// Validate checks that the mapping names either both coordinate columns or a
+// point column.
+func (g *GeoMapping) Validate() error {
+	switch {
+	case g.Column != "" && (g.Lat != "" || g.Lng != ""):
+		return fmt.Errorf("geo takes either column or lat and lng, not both")
+	case g.Column != "":
+	case g.Lat == "" || g.Lng == "":
+		return fmt.Errorf("geo needs a column, or both lat and lng")
+	}
+	return nil
+}
+
+// columns returns the source columns of the mapping.
+func (g *GeoMapping) columns() []string {
+	if g.Column != "" {
+		return []string{g.Column}
+	}
+	return []string{g.Lat, g.Lng}
+}
+
+// apply sets _geo on doc from its source columns. A PostGIS column is
+// replaced by _geo, since its hex encoding is of no use in the index. When
+// the source columns are absent, as in partial updates, doc is left
+// unchanged; when they are null, _geo is null.
+func (g *GeoMapping) apply(doc map[string]interface{}) error {
+	if g.Column != "" {
+		value, ok := doc[g.Column]
+		if !ok {
+			return nil
+		}
+		delete(doc, g.Column)
+		if value == nil {
+			doc[GeoField] = nil
+			return nil
+		}
+		lat, lng, err := decodePoint(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode geo column %s: %w", g.Column, err)
+		}
+		doc[GeoField] = map[string]float64{"lat": lat, "lng": lng}
+		return nil
+	}
+
+	latValue, latOK := doc[g.Lat]
+	lngValue, lngOK := doc[g.Lng]
+	if !latOK || !lngOK {
+		return nil
+	}
+	if latValue == nil || lngValue == nil {
+		doc[GeoField] = nil
+		return nil
+	}
+	lat, err := geoNumber(latValue)
+	if err != nil {
+		return fmt.Errorf("invalid latitude in %s: %w", g.Lat, err)
+	}
+	lng, err := geoNumber(lngValue)
+	if err != nil {
+		return fmt.Errorf("invalid longitude in %s: %w", g.Lng, err)
+	}
+	doc[GeoField] = map[string]float64{"lat": lat, "lng": lng}
+	return nil
+}
+
+// ensureGeoAttributes makes _geo filterable and sortable on the index,
+// keeping the attributes already configured.
+func ensureGeoAttributes(client meili.ServiceManager, uid string, l *log.Logger) error {
+	index := client.Index(uid)
+	filterable, err := index.GetFilterableAttributes()
+	if err != nil {
+		return fmt.Errorf("failed to get filterable attributes: %v", err)
+	}
+	if filterable == nil || !slices.Contains(*filterable, GeoField) {
+		attributes := []string{GeoField}
+		if filterable != nil {
+			attributes = append(*filterable, GeoField)
+		}
+		if _, err := index.UpdateFilterableAttributes(&attributes); err != nil {
+			return fmt.Errorf("failed to make %s filterable: %v", GeoField, err)
+		}
+		l.Printf("Made %s filterable on index %q", GeoField, uid)
+	}
+
+	sortable, err := index.GetSortableAttributes()
+	if err != nil {
+		return fmt.Errorf("failed to get sortable attributes: %v", err)
+	}
+	if sortable == nil || !slices.Contains(*sortable, GeoField) {
+		attributes := []string{GeoField}
+		if sortable != nil {
+			attributes = append(*sortable, GeoField)
+		}
+		if _, err := index.UpdateSortableAttributes(&attributes); err != nil {
+			return fmt.Errorf("failed to make %s sortable: %v", GeoField, err)
+		}
+		l.Printf("Made %s sortable on index %q", GeoField, uid)
+	}
+	return nil
+}
+
+// geoNumber converts a decoded numeric column value to a float.
+func geoNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	default:
+		return 0, fmt.Errorf("unsupported value %v (%T)", value, value)
+	}
+}
+
+// decodePoint reads the coordinates of a PostGIS point given as hex EWKB
+// (the text form wal2json sends), binary EWKB or WKT, with or without SRID.
+func decodePoint(value interface{}) (lat, lng float64, err error) {
+	var data []byte
+	switch v := value.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return 0, 0, fmt.Errorf("unsupported value %v (%T)", value, value)
+	}
+
+	text := strings.TrimSpace(string(data))
+	if raw, err := hex.DecodeString(text); err == nil && len(raw) > 0 {
+		return decodeWKBPoint(raw)
+	}
+	if len(data) > 0 && (data[0] == 0 || data[0] == 1) {
+		return decodeWKBPoint(data)
+	}
+	return decodeWKTPoint(text)
+}
+
+// EWKB type flags.
+const (
+	wkbZ    = 0x80000000
+	wkbM    = 0x40000000
+	wkbSRID = 0x20000000
+)
+
+func decodeWKBPoint(data []byte) (lat, lng float64, err error) {
+	if len(data) < 5 {
+		return 0, 0, fmt.Errorf("WKB too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 0 {
+		order = binary.BigEndian
+	}
+	geomType := order.Uint32(data[1:5])
+	offset := 5
+	if geomType&wkbSRID != 0 {
+		offset += 4
+	}
+	if (geomType&^(wkbZ|wkbM|wkbSRID))%1000 != 1 {
+		return 0, 0, fmt.Errorf("geometry type %d is not a point", geomType&^(wkbZ|wkbM|wkbSRID))
+	}
+	if len(data) < offset+16 {
+		return 0, 0, fmt.Errorf("WKB point too short")
+	}
+	lng = math.Float64frombits(order.Uint64(data[offset:]))
+	lat = math.Float64frombits(order.Uint64(data[offset+8:]))
+	if math.IsNaN(lat) || math.IsNaN(lng) {
+		return 0, 0, fmt.Errorf("empty point")
+	}
+	return lat, lng, nil
+}
+
+func decodeWKTPoint(text string) (lat, lng float64, err error) {
+	if i := strings.IndexByte(text, ';'); i >= 0 && strings.HasPrefix(strings.ToUpper(text), "SRID=") {
+		text = text[i+1:]
+	}
+	upper := strings.ToUpper(text)
+	open, end := strings.IndexByte(text, '('), strings.LastIndexByte(text, ')')
+	if !strings.HasPrefix(upper, "POINT") || open < 0 || end < open {
+		return 0, 0, fmt.Errorf("%q is not a point", text)
+	}
+	coords := strings.Fields(text[open+1 : end])
+	if len(coords) < 2 {
+		return 0, 0, fmt.Errorf("%q is not a point", text)
+	}
+	if lng, err = strconv.ParseFloat(coords[0], 64); err != nil {
+		return 0, 0, err
+	}
+	if lat, err = strconv.ParseFloat(coords[1], 64); err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
@@ -2,8 +2,12 @@ package meilisearch
 
 import (
 	"database/sql"
-	"encoding/json"
 	"log"
+	"sync"
+	"time"
+
+	"nats-jetstream/pkg/checkpoint"
+	"nats-jetstream/pkg/postgres"
 
 	meili "github.com/meilisearch/meilisearch-go"
 	"go.uber.org/zap"
@@ -23,10 +27,69 @@ type MeiliSearchHandler struct {
 	ApiKey         string
 	TableName      string
 	Index          string
+	// PK is the document id attribute: the key column, or with a composite
+	// key the attribute holding the encoded KeyColumns.
 	PK 		       string 
+	KeyColumns     []string
+	// IDStrategy turns the key into the document id: IDRaw (default),
+	// IDSlugify, IDBase32 or IDHash.
+	IDStrategy     string
 	EnableInitData bool
 	// WalDataChan chan []byte
 	DB             *sql.DB
+	// Checkpoints records the backfill cursor and the last enqueued task.
+	Checkpoints    checkpoint.Store
+	// Where is an optional SQL row filter; only matching rows are indexed.
+	Where          string
+	// Columns limits the indexed columns; the primary key is always kept.
+	Columns        []string
+	// SoftDelete, when set, removes soft-deleted rows from the index.
+	SoftDelete     *SoftDeleteRule
+	// Geo, when set, builds the _geo attribute from the row's coordinates.
+	Geo            *GeoMapping
+	// Vectors moves pgvector columns into _vectors for user-provided
+	// embedders.
+	Vectors        []VectorMapping
+	// Toast selects how updates with unchanged TOASTed columns are written,
+	// ToastPartial (default) or ToastFetch.
+	Toast          string
+	// WriteMode is WriteReplace (default) to replace documents, or
+	// WriteMerge to update only the fields that come from Postgres.
+	WriteMode      string
+	// IgnoreColumns are left out of the documents, so updates changing only
+	// them are dropped.
+	IgnoreColumns  []string
+	// HashCacheSize, when positive, keeps a hash of the last payload of up to
+	// that many documents to drop updates that would write the same document
+	// again when the old row is not available.
+	HashCacheSize  int
+	// CoalesceWindow, when positive, holds changes that long and collapses
+	// the changes of each document into its last state before writing.
+	CoalesceWindow time.Duration
+	// Logger receives the messages of the change stream, such as indexes
+	// created on first write. Defaults to log.Default().
+	Logger         *log.Logger
+
+	toastMu        sync.Mutex
+	toastColumns   []tableColumn
+
+	// indexes holds the indexes an Index template resolved to that were
+	// created and configured.
+	indexMu        sync.Mutex
+	indexes        map[string]bool
+
+	hashesOnce     sync.Once
+	hashes         *documentHashes
+
+	coalescerOnce  sync.Once
+	coalescer      *coalescer
+
+	// lastTask is the highest task uid seen, last saved at taskSaved;
+	// taskTimer is set while a save is scheduled.
+	taskMu         sync.Mutex
+	lastTask       int64
+	taskSaved      time.Time
+	taskTimer      *time.Timer
 }
 
 // func NewMeiliSearchHandler(db *sql.DB, client  meili.ServiceManager, baseURL, apiKey, tableName, index string, pk string, enableInitData bool, walDataChan chan[]byte, logger *log.Logger) (*MeiliSearchHandler, error) {
@@ -88,18 +151,67 @@ func (m *MeiliSearchHandler) HandleMessage(data []byte, logger *log.Logger) erro
 
 func (m *MeiliSearchHandler) InitializeData(l *log.Logger) error {
 
-	err  := m.CreateIndex(m.Client, l, m.Index, m.PK)
-
-	if err != nil {
-		l.Printf("Failed to create Meilisearch index: %v", err)
-	}
+	m.PrepareIndex(l)
 
 	if !m.EnableInitData {
 		l.Println("Data initialization for Meilisearch is disabled")
 		return nil
 	}
 
-	return InitializeMeilisearchDataByClient(m.DB, m, m.Client,l, m.Index, m.PK)
+	return m.Backfill(l)
+}
+
+// logger returns the handler's Logger, or the standard logger when unset.
+func (m *MeiliSearchHandler) logger() *log.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return log.Default()
+}
+
+// PrepareIndex creates the index and reports the outcome of the last task
+// enqueued before a restart. With an Index template the indexes are created
+// when first written to.
+func (m *MeiliSearchHandler) PrepareIndex(l *log.Logger) {
+	if !m.templated() {
+		if err := m.configureIndex(m.Index, l); err != nil {
+			l.Printf("Failed to create Meilisearch index: %v", err)
+		}
+	}
+
+	m.restoreLastTask(l)
+}
+
+// configureIndex creates the index if needed and applies the settings the
+// table's mappings depend on.
+func (m *MeiliSearchHandler) configureIndex(uid string, l *log.Logger) error {
+	if err := m.CreateIndex(m.Client, l, uid, m.PK); err != nil {
+		return err
+	}
+
+	if m.Geo != nil {
+		if err := ensureGeoAttributes(m.Client, uid, l); err != nil {
+			l.Printf("Failed to configure %s on index %q: %v", GeoField, uid, err)
+		}
+	}
+
+	if len(m.Vectors) > 0 {
+		if err := m.ensureEmbedders(uid, l); err != nil {
+			l.Printf("Failed to configure embedders on index %q: %v", uid, err)
+		}
+	}
+	return nil
+}
+
+// Backfill copies the table into the index, resuming from the saved cursor.
+func (m *MeiliSearchHandler) Backfill(l *log.Logger) error {
+	return InitializeMeilisearchDataByClient(m.DB, m, m.Client, l, m.Index, m.PK)
+}
+
+// ResetBackfill forgets the backfill progress, so the next Backfill copies
+// the whole table again.
+func (m *MeiliSearchHandler) ResetBackfill() error {
+	return m.saveBackfillCursor("")
 }
 
 func (m *MeiliSearchHandler) CreateWALCallback(l *log.Logger) func([]byte) {
@@ -119,28 +231,17 @@ func (m *MeiliSearchHandler) CreateWALCallback(l *log.Logger) func([]byte) {
 
 // Helper method to check if WAL message is for this handler's table
 func (m *MeiliSearchHandler) isForMyTable(data []byte, l *log.Logger) bool {
-    var walMessage struct {
-        Change []struct {
-            Table string `json:"table"`
-        } `json:"change"`
-    }
-    
-    if err := json.Unmarshal(data, &walMessage); err != nil {
-        l.Printf("Failed to parse WAL JSON: %v", err)
+    event, err := postgres.DecodeEvent(data)
+    if err != nil {
+        l.Printf("Failed to parse change event JSON: %v", err)
         return false
     }
     
-    if len(walMessage.Change) == 0 {
-        return false
-    }
-    
-    // Check if any change in the WAL message is for this table
-    for _, change := range walMessage.Change {
-        if change.Table == m.TableName {
-            return true
-        }
-    }
-    
-    return false
+    return event.QualifiedTable() == m.QualifiedTable()
+}
+
+// QualifiedTable returns the handler's table as schema.table.
+func (m *MeiliSearchHandler) QualifiedTable() string {
+	return postgres.ParseTableName(m.TableName).String()
 }
 
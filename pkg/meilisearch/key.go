@@ -0,0 +1,195 @@
+package meilisearch
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultIDField is the document attribute holding the synthetic id of rows
+// with a composite primary key.
+const DefaultIDField = "_id"
+
+// EncodeDocumentID combines key values into a Meilisearch document id. Each
+// value is normalized by keyString, then every byte outside [a-zA-Z0-9] is
+// written as "_" and two hex digits, and the parts are joined with "-". The
+// result only uses characters Meilisearch accepts in ids and decodes back
+// to the parts.
+func EncodeDocumentID(values []interface{}) string {
+	var b strings.Builder
+	for i, value := range values {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		s := keyString(value)
+		for j := 0; j < len(s); j++ {
+			c := s[j]
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "_%02x", c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// DecodeDocumentID splits an id built by EncodeDocumentID into the text of
+// its key values.
+func DecodeDocumentID(id string) ([]string, error) {
+	var parts []string
+	for _, encoded := range strings.Split(id, "-") {
+		var b strings.Builder
+		for i := 0; i < len(encoded); i++ {
+			if encoded[i] != '_' {
+				b.WriteByte(encoded[i])
+				continue
+			}
+			if i+2 >= len(encoded) {
+				return nil, fmt.Errorf("invalid document id %q", id)
+			}
+			c, err := strconv.ParseUint(encoded[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid document id %q", id)
+			}
+			b.WriteByte(byte(c))
+			i += 2
+		}
+		parts = append(parts, b.String())
+	}
+	return parts, nil
+}
+
+// keyString returns the Postgres text form of a key value, whether it was
+// decoded from a change event or read with ::text during the backfill, so
+// both produce the same document id.
+func keyString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999-07")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ID strategies turning key values into a document id.
+const (
+	// IDRaw uses a single key value unchanged; composite keys are escaped
+	// as with IDSlugify.
+	IDRaw = "raw"
+	// IDSlugify escapes the key text with EncodeDocumentID, keeping it
+	// readable and reversible.
+	IDSlugify = "slugify"
+	// IDBase32 encodes the key text in base32 (extended hex alphabet, which
+	// keeps the sort order of the text).
+	IDBase32 = "base32"
+	// IDHash uses the hex SHA-256 of the key text, which has a fixed length.
+	IDHash = "hash"
+)
+
+// maxDocumentIDLength is the longest id Meilisearch accepts, in bytes.
+const maxDocumentIDLength = 511
+
+var base32Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// EncodeID builds a document id from key values with the given strategy.
+// Ids that Meilisearch would reject for their length are an error, except
+// for IDRaw, where the value is passed on as it is.
+func EncodeID(strategy string, values []interface{}) (string, error) {
+	var id string
+	switch strategy {
+	case "", IDRaw:
+		if len(values) == 1 {
+			return fmt.Sprintf("%v", values[0]), nil
+		}
+		id = EncodeDocumentID(values)
+	case IDSlugify:
+		id = EncodeDocumentID(values)
+	case IDBase32:
+		id = base32Encoding.EncodeToString([]byte(joinKey(values)))
+	case IDHash:
+		sum := sha256.Sum256([]byte(joinKey(values)))
+		return hex.EncodeToString(sum[:]), nil
+	default:
+		return "", fmt.Errorf("unknown id strategy %q", strategy)
+	}
+	if len(id) > maxDocumentIDLength {
+		return "", fmt.Errorf("document id of %d bytes exceeds the Meilisearch limit of %d; use id_strategy hash", len(id), maxDocumentIDLength)
+	}
+	return id, nil
+}
+
+// joinKey joins the key text with NUL, which cannot occur in Postgres text.
+func joinKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = keyString(value)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// SyntheticID reports whether documents get a separate id attribute instead
+// of using the key column as their id.
+func SyntheticID(strategy string, keyColumns []string) bool {
+	return len(keyColumns) > 1 || (strategy != "" && strategy != IDRaw)
+}
+
+// keyColumns returns the primary key columns of the table.
+func (m *MeiliSearchHandler) keyColumns() []string {
+	if len(m.KeyColumns) > 0 {
+		return m.KeyColumns
+	}
+	return []string{m.PK}
+}
+
+// synthetic reports whether documents are identified by a synthetic id.
+func (m *MeiliSearchHandler) synthetic() bool {
+	return SyntheticID(m.IDStrategy, m.keyColumns())
+}
+
+// keyValues collects the key columns of a row, looking up each column in the
+// given rows in turn.
+func keyValues(columns []string, rows ...map[string]interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		found := false
+		for _, row := range rows {
+			if value, ok := row[column]; ok {
+				values[i], found = value, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("primary key %q not found in change", column)
+		}
+	}
+	return values, nil
+}
+
+func documentID(strategy string, columns []string, rows ...map[string]interface{}) (string, error) {
+	values, err := keyValues(columns, rows...)
+	if err != nil {
+		return "", err
+	}
+	return EncodeID(strategy, values)
+}
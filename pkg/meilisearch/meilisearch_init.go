@@ -9,6 +9,8 @@ import (
 	"log"
 	"net/http"
 
+	"nats-jetstream/pkg/checkpoint"
+
 	meili "github.com/meilisearch/meilisearch-go"
 )
 
@@ -69,17 +71,93 @@ func InitializeMeilisearchDataByClient(
 	index string ,
 	pk string,
 ) error {
-	documents, err := handler.fetchDataFromDatabase(db)
+	cursor, err := handler.loadBackfillCursor()
 	if err != nil {
-		return fmt.Errorf("failed to fetch data from PostgreSQL: %v", err)
+		return err
+	}
+	if cursor == checkpoint.BackfillDone {
+		l.Printf("Meilisearch index '%s' was already initialized from table %s", index, handler.TableName)
+		return nil
+	}
+	if cursor != "" {
+		l.Printf("Resuming initialization of Meilisearch index '%s' after %s = %s", index, pk, cursor)
 	}
 
-	_, err = meiliClient.Index(index).AddDocuments(documents, pk)
-	if err != nil {
-		return fmt.Errorf("failed to add documents to Meilisearch: %v", err)
+	total := 0
+	for {
+		documents, next, err := handler.fetchPageFromDatabase(db, cursor, backfillPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to fetch data from PostgreSQL: %v", err)
+		}
+		if len(documents) == 0 {
+			break
+		}
+
+		if handler.templated() {
+			if err := handler.addTenantDocuments(documents, l); err != nil {
+				return err
+			}
+		} else {
+			task, err := handler.writeDocuments(meiliClient.Index(index), documents)
+			if err != nil {
+				return fmt.Errorf("failed to add documents to Meilisearch: %v", err)
+			}
+			handler.saveTask(task.TaskUID, l)
+		}
+
+		total += len(documents)
+		cursor = next
+		if err := handler.saveBackfillCursor(cursor); err != nil {
+			return err
+		}
+	}
+
+	if err := handler.saveBackfillCursor(checkpoint.BackfillDone); err != nil {
+		return err
 	}
 
-	l.Printf("Successfully initialized Meilisearch index '%s' with %d documents", index, len(documents))
+	l.Printf("Successfully initialized Meilisearch index '%s' with %d documents", index, total)
+	return nil
+}
+
+// writeDocuments adds backfilled documents to the index, merging them into
+// existing documents with WriteMerge.
+func (m *MeiliSearchHandler) writeDocuments(index meili.IndexManager, documents []map[string]interface{}) (*meili.TaskInfo, error) {
+	if m.WriteMode == WriteMerge {
+		return index.UpdateDocuments(documents, m.PK)
+	}
+	return index.AddDocuments(documents, m.PK)
+}
+
+// addTenantDocuments splits a backfill page by the index each document
+// resolves to and adds every part to its index, creating it if needed.
+func (m *MeiliSearchHandler) addTenantDocuments(documents []map[string]interface{}, l *log.Logger) error {
+	var order []string
+	byIndex := make(map[string][]map[string]interface{})
+	for _, doc := range documents {
+		index, ok, err := m.indexFor(doc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("row of %s lacks the columns of index %q", m.TableName, m.Index)
+		}
+		if _, seen := byIndex[index]; !seen {
+			order = append(order, index)
+		}
+		byIndex[index] = append(byIndex[index], doc)
+	}
+
+	for _, index := range order {
+		if err := m.ensureIndex(index, l); err != nil {
+			return err
+		}
+		task, err := m.writeDocuments(m.Client.Index(index), byIndex[index])
+		if err != nil {
+			return fmt.Errorf("failed to add documents to Meilisearch index %s: %v", index, err)
+		}
+		m.saveTask(task.TaskUID, l)
+	}
 	return nil
 }
 
@@ -7,40 +7,86 @@ import (
 	"log"
 	"nats-jetstream/pkg/postgres"
 	"net/http"
+	"net/url"
 )
 
+// How inserted and updated rows are written to their documents.
+const (
+	// WriteReplace replaces the whole document (POST /documents).
+	WriteReplace = "replace"
+	// WriteMerge updates only the fields sent from Postgres (PUT
+	// /documents), keeping fields other writers added to the document.
+	WriteMerge = "merge"
+)
+
+// documentsMethod returns the HTTP method for a documents request: PUT for
+// merges and partial updates, POST otherwise.
+func (m *MeiliSearchHandler) documentsMethod(partial bool) string {
+	if partial || m.WriteMode == WriteMerge {
+		return "PUT"
+	}
+	return "POST"
+}
+
 func (m *MeiliSearchHandler) ProcessWalData(data []byte, l *log.Logger) error {
 
 	l.Printf("WAL data In process: %s", string(data))
-	var walData postgres.WALData
-	err := json.Unmarshal(data, &walData)
+	event, err := postgres.DecodeEvent(data)
 
 	if err != nil {
-		l.Printf("Error unmarshalling WAL data: %v", err)
+		l.Printf("Error unmarshalling change event: %v", err)
 		return err
 	}
 
-	for _, change := range walData.Change {
-		if err := m.ProcessChange(change); err != nil {
-			l.Printf("Error processing change: %v", err)
-			return err
-		}
+	if err := m.ProcessChange(event); err != nil {
+		l.Printf("Error processing change: %v", err)
+		return err
 	}
 
 	return nil
 }
 
-func (m *MeiliSearchHandler) ProcessChange(change postgres.WALChange) error {
+func (m *MeiliSearchHandler) ProcessChange(change postgres.ChangeEvent) error {
+	if m.templated() {
+		return m.ProcessChanges([]postgres.ChangeEvent{change})
+	}
+
 	var endpoint, method string
 	var payload []byte
 
 	processor := DefaultMeilisearchProcessor[string]{
 		PrimaryKey: m.PK,
+		KeyColumns: m.KeyColumns,
+		IDStrategy: m.IDStrategy,
+		Geo:        m.Geo,
+		Vectors:    m.Vectors,
+	}
+
+	change, partial, err := m.applyToast(change)
+	if err != nil {
+		return err
 	}
 
+	if m.unchangedUpdate(change) {
+		skipUpdate()
+		return nil
+	}
+
+	matches, err := m.filterMatches([]postgres.ChangeEvent{change})
+	if err != nil {
+		return err
+	}
+	change, ok := m.applyFilter(change, matches[0])
+	if !ok {
+		return nil
+	}
+
+	hashes := m.documentHashes()
+	var hashKey string
+
 	changeJSON, _ := json.Marshal(change)
 	fmt.Println("orginal change:", string(changeJSON))
-	switch change.Kind {
+	switch change.Op {
 	case "insert", "update":
 		preparePayload, err := processor.preparePayload(change)
 
@@ -49,20 +95,216 @@ func (m *MeiliSearchHandler) ProcessChange(change postgres.WALChange) error {
 		}
 		payload = preparePayload
 
-		method = "POST"
+		if hashes != nil {
+			id, err := processor.extractIDFromChange(change)
+			if err != nil {
+				return fmt.Errorf("failed to extract ID: %w", err)
+			}
+			hashKey = documentKey(m.Index, id)
+			if partial {
+				hashes.forget(hashKey)
+				hashKey = ""
+			} else if change.Op == "update" && hashes.seen(hashKey, payload) {
+				skipUpdate()
+				return nil
+			}
+		}
+
+		method = m.documentsMethod(partial)
 		endpoint = fmt.Sprintf("%s/indexes/%s/documents", m.BaseURL, m.Index)
 	case "delete":
 		id, err := processor.extractIDFromChange(change)
 		if err != nil {
 			return fmt.Errorf("failed to extract ID: %w", err)
 		}
+		if hashes != nil {
+			hashes.forget(documentKey(m.Index, id))
+		}
 		method = "DELETE"
-		endpoint = fmt.Sprintf("%s/indexes/%s/documents/%s", m.BaseURL, m.Index, id)
+		endpoint = fmt.Sprintf("%s/indexes/%s/documents/%s", m.BaseURL, m.Index, url.PathEscape(id))
 	default:
-		return fmt.Errorf("unknown change kind: %s", change.Kind)
+		return fmt.Errorf("unknown change kind: %s", change.Op)
 	}
 
-	return m.sendHTTPRequest(method, endpoint, payload)
+	if err := m.sendHTTPRequest(method, endpoint, payload); err != nil {
+		return err
+	}
+	if hashKey != "" {
+		hashes.remember(hashKey, payload)
+	}
+	return nil
+}
+
+// ProcessChanges applies changes in order, folding each run of consecutive
+// inserts/updates into one documents request and each run of consecutive
+// deletes into one delete-batch request. Partial updates go into their own
+// run, since they are sent with PUT. With an Index template the changes are
+// first split by the index they resolve to, keeping their order per index.
+func (m *MeiliSearchHandler) ProcessChanges(changes []postgres.ChangeEvent) error {
+	var pending []postgres.ChangeEvent
+	var partials []bool
+	for _, change := range changes {
+		change, partial, err := m.applyToast(change)
+		if err != nil {
+			return err
+		}
+		if m.unchangedUpdate(change) {
+			skipUpdate()
+			continue
+		}
+		pending = append(pending, change)
+		partials = append(partials, partial)
+	}
+
+	matches, err := m.filterMatches(pending)
+	if err != nil {
+		return err
+	}
+
+	var order []string
+	byIndex := make(map[string][]indexedChange)
+
+	for i, change := range pending {
+		change, ok := m.applyFilter(change, matches[i])
+		if !ok {
+			continue
+		}
+
+		routed, err := m.route(change, partials[i])
+		if err != nil {
+			return err
+		}
+		for _, r := range routed {
+			if _, ok := byIndex[r.index]; !ok {
+				order = append(order, r.index)
+			}
+			byIndex[r.index] = append(byIndex[r.index], r)
+		}
+	}
+
+	for _, index := range order {
+		if err := m.writeChanges(index, byIndex[index]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChanges sends the changes of one index, batching runs of the same
+// kind. A resolved template index is created before its first documents.
+func (m *MeiliSearchHandler) writeChanges(index string, changes []indexedChange) error {
+	processor := DefaultMeilisearchProcessor[string]{
+		PrimaryKey: m.PK,
+		KeyColumns: m.KeyColumns,
+		IDStrategy: m.IDStrategy,
+		Geo:        m.Geo,
+		Vectors:    m.Vectors,
+	}
+
+	hashes := m.documentHashes()
+	// written holds the hash keys of the documents in the pending batch, so
+	// their payloads are remembered once the batch is sent.
+	type written struct {
+		key     string
+		payload []byte
+	}
+
+	var documents []json.RawMessage
+	var documentsMethod string
+	var pending []written
+	var ids []string
+
+	flushDocuments := func() error {
+		if len(documents) == 0 {
+			return nil
+		}
+		if m.templated() {
+			if err := m.ensureIndex(index, m.logger()); err != nil {
+				return err
+			}
+		}
+		payload, err := json.Marshal(documents)
+		if err != nil {
+			return fmt.Errorf("failed to marshal documents: %w", err)
+		}
+		documents = documents[:0]
+		if err := m.sendHTTPRequest(documentsMethod, fmt.Sprintf("%s/indexes/%s/documents", m.BaseURL, index), payload); err != nil {
+			return err
+		}
+		for _, w := range pending {
+			hashes.remember(w.key, w.payload)
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	flushDeletes := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		payload, err := json.Marshal(ids)
+		if err != nil {
+			return fmt.Errorf("failed to marshal document ids: %w", err)
+		}
+		ids = ids[:0]
+		return m.sendHTTPRequest("POST", fmt.Sprintf("%s/indexes/%s/documents/delete-batch", m.BaseURL, index), payload)
+	}
+
+	for _, c := range changes {
+		switch c.change.Op {
+		case "insert", "update":
+			if err := flushDeletes(); err != nil {
+				return err
+			}
+			method := m.documentsMethod(c.partial)
+			if method != documentsMethod {
+				if err := flushDocuments(); err != nil {
+					return err
+				}
+				documentsMethod = method
+			}
+			payload, err := processor.preparePayload(c.change)
+			if err != nil {
+				return fmt.Errorf("failed to prepare payload: %w", err)
+			}
+			if hashes != nil {
+				id, err := processor.extractIDFromChange(c.change)
+				if err != nil {
+					return fmt.Errorf("failed to extract ID: %w", err)
+				}
+				key := documentKey(index, id)
+				switch {
+				case c.partial:
+					hashes.forget(key)
+				case c.change.Op == "update" && hashes.seen(key, payload):
+					skipUpdate()
+					continue
+				default:
+					pending = append(pending, written{key: key, payload: payload})
+				}
+			}
+			documents = append(documents, payload)
+		case "delete":
+			if err := flushDocuments(); err != nil {
+				return err
+			}
+			id, err := processor.extractIDFromChange(c.change)
+			if err != nil {
+				return fmt.Errorf("failed to extract ID: %w", err)
+			}
+			if hashes != nil {
+				hashes.forget(documentKey(index, id))
+			}
+			ids = append(ids, id)
+		default:
+			return fmt.Errorf("unknown change kind: %s", c.change.Op)
+		}
+	}
+
+	if err := flushDocuments(); err != nil {
+		return err
+	}
+	return flushDeletes()
 }
 
 func (m *MeiliSearchHandler) sendHTTPRequest(method, endpoint string, payload []byte) error {
@@ -88,6 +330,13 @@ func (m *MeiliSearchHandler) sendHTTPRequest(method, endpoint string, payload []
 		return fmt.Errorf("request failed with status %s", resp.Status)
 	}
 
+	var task struct {
+		TaskUID int64 `json:"taskUid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err == nil {
+		m.saveTask(task.TaskUID, m.logger())
+	}
+
 	log.Println("Successfully synced data with Meilisearch:", string(payload))
 	return nil
 }
@@ -0,0 +1,151 @@
+package meilisearch
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"nats-jetstream/pkg/postgres"
+)
+
+// Defaults for ApplyPool.
+const (
+	DefaultApplyWorkers    = 4
+	DefaultApplyQueueDepth = 256
+)
+
+// maxApplyBatch caps how many queued changes a worker writes at once.
+const maxApplyBatch = 1000
+
+type applyItem struct {
+	handler *MeiliSearchHandler
+	change  postgres.ChangeEvent
+}
+
+// ApplyPool applies changes on a fixed number of workers. Changes are
+// partitioned by a hash of their index and document key, so the changes of
+// one document are applied in order by the same worker while other
+// documents and tables proceed in parallel. Each worker has a bounded
+// queue; Submit blocks while it is full, which slows the replication loop
+// down to the pace Meilisearch accepts writes.
+type ApplyPool struct {
+	queues    []chan applyItem
+	depth     int
+	watermark *postgres.Watermark
+	logger    *log.Logger
+	wg        sync.WaitGroup
+}
+
+// NewApplyPool starts workers workers with queues of depth changes each.
+// watermark, when set, tracks the changes submitted but not yet applied.
+func NewApplyPool(workers, depth int, watermark *postgres.Watermark, l *log.Logger) *ApplyPool {
+	if workers <= 0 {
+		workers = DefaultApplyWorkers
+	}
+	if depth <= 0 {
+		depth = DefaultApplyQueueDepth
+	}
+
+	p := &ApplyPool{
+		queues:    make([]chan applyItem, workers),
+		depth:     depth,
+		watermark: watermark,
+		logger:    l,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan applyItem, depth)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// Submit queues a change for handler.
+func (p *ApplyPool) Submit(handler *MeiliSearchHandler, change postgres.ChangeEvent) {
+	if p.watermark != nil {
+		if lsn, err := postgres.ParseLSN(change.LSN); err == nil && lsn > 0 {
+			p.watermark.Add(lsn)
+		}
+	}
+	p.queues[p.partition(handler, change)] <- applyItem{handler: handler, change: change}
+}
+
+// Workers returns the number of workers.
+func (p *ApplyPool) Workers() int {
+	return len(p.queues)
+}
+
+// Close stops accepting changes and waits for the queued ones to be applied.
+func (p *ApplyPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// partition picks the worker of a change from its index and document key.
+// A change without a complete key is partitioned by its index alone.
+func (p *ApplyPool) partition(handler *MeiliSearchHandler, change postgres.ChangeEvent) int {
+	h := fnv.New32a()
+	h.Write([]byte(handler.Index))
+	if values, err := keyValues(handler.keyColumns(), change.PK, change.Before, change.After); err == nil {
+		h.Write([]byte{0})
+		h.Write([]byte(EncodeDocumentID(values)))
+	}
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// work applies the changes of one queue. Whatever is queued when a worker
+// gets to it is written together, one call per handler in order of first
+// appearance, which keeps the order of each document. Tables with a
+// CoalesceWindow hold their changes, and only count as applied, until the
+// window ends; at most a queue's depth of them is held before the worker
+// waits for the window's flush. A failed write is retried until it
+// succeeds, holding back the later changes of its table and the confirmed
+// position.
+func (p *ApplyPool) work(queue chan applyItem) {
+	defer p.wg.Done()
+	for item := range queue {
+		items := []applyItem{item}
+	drain:
+		for len(items) < maxApplyBatch {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				items = append(items, next)
+			default:
+				break drain
+			}
+		}
+		p.apply(items)
+	}
+}
+
+func (p *ApplyPool) apply(items []applyItem) {
+	var handlers []*MeiliSearchHandler
+	changes := make(map[*MeiliSearchHandler][]postgres.ChangeEvent)
+	for _, item := range items {
+		if _, seen := changes[item.handler]; !seen {
+			handlers = append(handlers, item.handler)
+		}
+		changes[item.handler] = append(changes[item.handler], item.change)
+	}
+
+	for _, handler := range handlers {
+		handler, batch := handler, changes[handler]
+		handler.CoalesceUntilApplied(batch, func(err error) {
+			// Changes that were not applied stay pending, so the confirmed
+			// position does not pass them.
+			if err != nil || p.watermark == nil {
+				return
+			}
+			for _, change := range batch {
+				if lsn, err := postgres.ParseLSN(change.LSN); err == nil && lsn > 0 {
+					p.watermark.Done(lsn)
+				}
+			}
+		}, p.depth, p.logger)
+	}
+}
@@ -5,24 +5,53 @@ import (
 	"encoding/json"
 	"fmt"
 	"nats-jetstream/pkg/postgres"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
 )
 
 type DefaultMeilisearchProcessor[T any] struct{
 	PrimaryKey string
+	// KeyColumns are the table's key columns. With several of them, or an
+	// IDStrategy other than IDRaw, the document id is their encoding,
+	// stored in the PrimaryKey attribute.
+	KeyColumns []string
+	IDStrategy string
+	Geo        *GeoMapping
+	Vectors    []VectorMapping
+}
+
+func (p *DefaultMeilisearchProcessor[T]) keyColumns() []string {
+	if len(p.KeyColumns) > 0 {
+		return p.KeyColumns
+	}
+	return []string{p.PrimaryKey}
 }
 
-func (p *DefaultMeilisearchProcessor[T]) preparePayload(change postgres.WALChange) ([]byte, error) {
-	payload := make(map[string]interface{})
+func (p *DefaultMeilisearchProcessor[T]) preparePayload(change postgres.ChangeEvent) ([]byte, error) {
+	payload := make(map[string]interface{}, len(change.After)+1)
 
-	var columnValues []interface{}
-	if err := json.Unmarshal(change.ColumnValues, &columnValues); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal column values: %w", err)
+	for colName, value := range change.After {
+		payload[colName] = value
 	}
 
-	for i, colName := range change.ColumnNames {
-		if i < len(columnValues) {
-			payload[colName] = columnValues[i]
+	if SyntheticID(p.IDStrategy, p.keyColumns()) {
+		id, err := documentID(p.IDStrategy, p.keyColumns(), change.After)
+		if err != nil {
+			return nil, err
 		}
+		payload[p.PrimaryKey] = id
+	}
+
+	if p.Geo != nil {
+		if err := p.Geo.apply(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyVectors(p.Vectors, payload); err != nil {
+		return nil, err
 	}
 
 	jsonPayload, err := json.Marshal(payload)
@@ -32,36 +61,160 @@ func (p *DefaultMeilisearchProcessor[T]) preparePayload(change postgres.WALChang
 
 	return jsonPayload, nil
 }
-func (p *DefaultMeilisearchProcessor[T]) extractIDFromChange(change postgres.WALChange) (string, error) {
-    if change.OldKeys == nil {
+func (p *DefaultMeilisearchProcessor[T]) extractIDFromChange(change postgres.ChangeEvent) (string, error) {
+    if values, err := keyValues(p.keyColumns(), change.PK); err == nil {
+        return EncodeID(p.IDStrategy, values)
+    }
+
+    if change.Before == nil {
         return "", fmt.Errorf("oldkeys field is missing")
     }
 
-    // Since KeyValues is json.RawMessage, unmarshal it properly
-    var keyValues []interface{}
-    if err := json.Unmarshal(change.OldKeys.KeyValues, &keyValues); err != nil {
-        return "", fmt.Errorf("failed to unmarshal key values: %w", err)
+    values, err := keyValues(p.keyColumns(), change.PK, change.Before)
+    if err != nil {
+        return "", fmt.Errorf("%w in oldkeys", err)
     }
+    return EncodeID(p.IDStrategy, values)
+}
 
+// fetchPageFromDatabase reads up to limit rows ordered by the primary key,
+// starting after cursor, and returns the cursor of the last row. The cursor
+// is the text form of the last key read, or with a composite key the text of
+// every key column encoded with EncodeDocumentID.
+func (m *MeiliSearchHandler) fetchPageFromDatabase(db *sql.DB, cursor string, limit int) ([]map[string]interface{}, string, error) {
+	table := postgres.ParseTableName(m.TableName).Sanitize()
+	keys := m.keyColumns()
+	quotedKeys := make([]string, len(keys))
+	cursorColumns := make([]string, len(keys))
+	for i, key := range keys {
+		quotedKeys[i] = "t." + pgx.Identifier{key}.Sanitize()
+		cursorColumns[i] = fmt.Sprintf("%s::text AS %s_%d", quotedKeys[i], cursorColumn, i)
+	}
 
-    for i, keyName := range change.OldKeys.KeyNames {
-        if keyName == p.PrimaryKey {
-            if i >= len(keyValues) {
-                return "", fmt.Errorf("primary key index out of range")
-            }
-            
-            idValue := keyValues[i]
-            stringID := fmt.Sprintf("%v", idValue)
-            
-            return stringID, nil
-        }
-    }
+	selected := "t.*"
+	if len(m.Columns) > 0 {
+		columns := append([]string{}, quotedKeys...)
+		for _, column := range m.projectedColumns() {
+			if !slices.Contains(keys, column) {
+				columns = append(columns, "t."+pgx.Identifier{column}.Sanitize())
+			}
+		}
+		selected = strings.Join(columns, ", ")
+	}
 
-    return "", fmt.Errorf("primary key %q not found in oldkeys", p.PrimaryKey)
+	query := fmt.Sprintf("SELECT %s, %s FROM %s AS t", selected, strings.Join(cursorColumns, ", "), table)
+	args := []interface{}{}
+	var conditions []string
+	if m.Where != "" {
+		conditions = append(conditions, "("+m.Where+")")
+	}
+	if m.SoftDelete != nil {
+		conditions = append(conditions, m.SoftDelete.LiveSQL())
+	}
+	if cursor != "" {
+		keyTypes, err := m.keyTypes(db)
+		if err != nil {
+			return nil, "", err
+		}
+		parts := []string{cursor}
+		if len(keys) > 1 {
+			if parts, err = DecodeDocumentID(cursor); err != nil {
+				return nil, "", err
+			}
+			if len(parts) != len(keys) {
+				return nil, "", fmt.Errorf("backfill cursor %q does not match the key of %s", cursor, m.TableName)
+			}
+		}
+		placeholders := make([]string, len(keys))
+		for i, part := range parts {
+			args = append(args, part)
+			placeholders[i] = fmt.Sprintf("$%d::text::%s", i+1, keyTypes[i])
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s) > (%s)", strings.Join(quotedKeys, ", "), strings.Join(placeholders, ", ")))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(quotedKeys, ", "), limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query from Database: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get columns: %v", err)
+	}
+
+	var documents []map[string]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, "", fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		doc := make(map[string]interface{})
+		keyValues := make([]interface{}, 0, len(keys))
+		for i, col := range columns {
+			if strings.HasPrefix(col, cursorColumn+"_") {
+				keyValues = append(keyValues, values[i])
+				continue
+			}
+			doc[col] = values[i]
+		}
+
+		if len(keys) > 1 {
+			cursor = EncodeDocumentID(keyValues)
+		} else {
+			cursor = keyString(keyValues[0])
+		}
+		if m.synthetic() {
+			id, err := EncodeID(m.IDStrategy, keyValues)
+			if err != nil {
+				return nil, "", err
+			}
+			doc[m.PK] = id
+		}
+		if m.Geo != nil {
+			if err := m.Geo.apply(doc); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := applyVectors(m.Vectors, doc); err != nil {
+			return nil, "", err
+		}
+		documents = append(documents, doc)
+	}
+
+	return documents, cursor, rows.Err()
+}
+
+// keyTypes returns the SQL types of the key columns, used to compare against
+// key values passed as text.
+func (m *MeiliSearchHandler) keyTypes(db *sql.DB) ([]string, error) {
+	keys := m.keyColumns()
+	types := make([]string, len(keys))
+	for i, key := range keys {
+		err := db.QueryRow(
+			"SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attname = $2",
+			postgres.ParseTableName(m.TableName).Sanitize(), key,
+		).Scan(&types[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up type of %s.%s: %v", m.TableName, key, err)
+		}
+	}
+	return types, nil
 }
 
 func (m *MeiliSearchHandler) fetchDataFromDatabase(db *sql.DB) ([]map[string]interface{}, error) {
-	query := fmt.Sprintf("SELECT * FROM %s", m.TableName)
+	query := fmt.Sprintf("SELECT * FROM %s", postgres.ParseTableName(m.TableName).Sanitize())
 	rows, err := db.Query(query)
 
 	if err != nil {
@@ -0,0 +1,80 @@
+package meilisearch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Soft-delete conditions.
+const (
+	// SoftDeleteNotNull marks a row deleted when the column is set, as with
+	// deleted_at timestamps.
+	SoftDeleteNotNull = "not_null"
+	// SoftDeleteTrue marks a row deleted when the boolean column is true, as
+	// with is_archived flags.
+	SoftDeleteTrue = "true"
+	// SoftDeleteEquals marks a row deleted when the column's text equals
+	// Value, as with status = 'deleted'.
+	SoftDeleteEquals = "equals"
+)
+
+// SoftDeleteRule describes how a table marks rows as deleted without
+// deleting them. Such rows are removed from the index and left out of the
+// backfill; a row that is restored is indexed again.
+type SoftDeleteRule struct {
+	Column    string
+	Condition string
+	Value     string
+}
+
+// Validate checks the rule's condition.
+func (r *SoftDeleteRule) Validate() error {
+	if r.Column == "" {
+		return fmt.Errorf("soft_delete needs a column")
+	}
+	switch r.Condition {
+	case "", SoftDeleteNotNull, SoftDeleteTrue:
+	case SoftDeleteEquals:
+		if r.Value == "" {
+			return fmt.Errorf("soft_delete condition %q needs a value", r.Condition)
+		}
+	default:
+		return fmt.Errorf("unknown soft_delete condition %q: expected %s, %s or %s", r.Condition, SoftDeleteNotNull, SoftDeleteTrue, SoftDeleteEquals)
+	}
+	return nil
+}
+
+// Deleted reports whether a row is soft-deleted.
+func (r *SoftDeleteRule) Deleted(row map[string]interface{}) bool {
+	value := row[r.Column]
+	switch r.Condition {
+	case SoftDeleteTrue:
+		switch v := value.(type) {
+		case bool:
+			return v
+		case string:
+			return v == "true" || v == "t"
+		}
+		return false
+	case SoftDeleteEquals:
+		return value != nil && keyString(value) == r.Value
+	default:
+		return value != nil
+	}
+}
+
+// LiveSQL returns a SQL condition over the table alias t that holds for rows
+// that are not soft-deleted.
+func (r *SoftDeleteRule) LiveSQL() string {
+	column := "t." + pgx.Identifier{r.Column}.Sanitize()
+	switch r.Condition {
+	case SoftDeleteTrue:
+		return column + " IS NOT TRUE"
+	case SoftDeleteEquals:
+		return fmt.Sprintf("%s::text IS DISTINCT FROM '%s'", column, strings.ReplaceAll(r.Value, "'", "''"))
+	default:
+		return column + " IS NULL"
+	}
+}
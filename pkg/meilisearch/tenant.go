@@ -0,0 +1,158 @@
+package meilisearch
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"nats-jetstream/pkg/postgres"
+)
+
+// indexPlaceholder matches the {column} parts of an index template such as
+// products_{tenant_id}.
+var indexPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// IndexColumns returns the columns an index template is resolved from, or
+// nil for a plain index name.
+func IndexColumns(template string) []string {
+	var columns []string
+	for _, match := range indexPlaceholder.FindAllStringSubmatch(template, -1) {
+		columns = append(columns, match[1])
+	}
+	return columns
+}
+
+// templated reports whether the handler's index is resolved per row.
+func (m *MeiliSearchHandler) templated() bool {
+	return indexPlaceholder.MatchString(m.Index)
+}
+
+// indexFor resolves the index template for a row. ok is false when the row
+// lacks one of the template's columns.
+func (m *MeiliSearchHandler) indexFor(row map[string]interface{}) (index string, ok bool, err error) {
+	ok = true
+	index = indexPlaceholder.ReplaceAllStringFunc(m.Index, func(placeholder string) string {
+		column := placeholder[1 : len(placeholder)-1]
+		value, found := row[column]
+		if !found {
+			ok = false
+			return ""
+		}
+		if value == nil {
+			err = fmt.Errorf("column %s of %s is null and cannot select an index for %q", column, m.TableName, m.Index)
+			return ""
+		}
+		return indexSegment(keyString(value))
+	})
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	return index, true, nil
+}
+
+// indexSegment makes a column value usable in an index uid, which allows
+// only letters, digits, hyphens and underscores. Other bytes, and the
+// underscore itself so values cannot collide, are written as _xx in hex.
+func indexSegment(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "_%02x", c)
+	}
+	return b.String()
+}
+
+// ensureIndex creates a resolved index with the configured settings the
+// first time it is written to.
+func (m *MeiliSearchHandler) ensureIndex(uid string, l *log.Logger) error {
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	if m.indexes[uid] {
+		return nil
+	}
+	if err := m.configureIndex(uid, l); err != nil {
+		return err
+	}
+	if m.indexes == nil {
+		m.indexes = make(map[string]bool)
+	}
+	m.indexes[uid] = true
+	return nil
+}
+
+// indexedChange is a change bound for one index.
+type indexedChange struct {
+	index   string
+	change  postgres.ChangeEvent
+	partial bool
+}
+
+// route picks the indexes a change is written to. An upsert goes to the
+// index of its new row and, when the old row was in another index, a delete
+// goes to that one. The template columns are part of the replica identity,
+// so the old row Postgres sends holds them whenever they changed; when it
+// does not, the row stayed in its index.
+func (m *MeiliSearchHandler) route(change postgres.ChangeEvent, partial bool) ([]indexedChange, error) {
+	if !m.templated() {
+		return []indexedChange{{index: m.Index, change: change, partial: partial}}, nil
+	}
+
+	switch change.Op {
+	case "insert", "update":
+		index, ok, err := m.indexFor(change.After)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("change of %s lacks the columns of index %q", m.TableName, m.Index)
+		}
+		routed := []indexedChange{{index: index, change: change, partial: partial}}
+		if change.Op == "insert" {
+			return routed, nil
+		}
+
+		old, ok, err := m.indexFor(change.Before)
+		if err != nil {
+			return nil, err
+		}
+		if ok && old != index {
+			routed = append([]indexedChange{{index: old, change: m.oldDelete(change)}}, routed...)
+		}
+		return routed, nil
+	case "delete":
+		for _, row := range []map[string]interface{}{change.Before, change.PK, change.After} {
+			index, ok, err := m.indexFor(row)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return []indexedChange{{index: index, change: change}}, nil
+			}
+		}
+		return nil, fmt.Errorf("delete from %s lacks the columns of index %q", m.TableName, m.Index)
+	default:
+		return nil, fmt.Errorf("unknown change kind: %s", change.Op)
+	}
+}
+
+// oldDelete turns an update into a delete of the old row's document. The
+// old key columns Postgres sends in Before are used when complete, since the
+// update may have changed the key.
+func (m *MeiliSearchHandler) oldDelete(change postgres.ChangeEvent) postgres.ChangeEvent {
+	pk := make(map[string]interface{}, len(m.keyColumns()))
+	for _, column := range m.keyColumns() {
+		value, ok := change.Before[column]
+		if !ok {
+			return m.asDelete(change)
+		}
+		pk[column] = value
+	}
+	change.Op = "delete"
+	change.PK = pk
+	return change
+}
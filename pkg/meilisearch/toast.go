@@ -0,0 +1,207 @@
+package meilisearch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// How updates with unchanged TOASTed columns are written.
+const (
+	// ToastPartial writes the update as a partial document update, leaving
+	// the omitted fields of the indexed document untouched.
+	ToastPartial = "partial"
+	// ToastFetch reads the omitted values from Postgres and writes the full
+	// document.
+	ToastFetch = "fetch"
+)
+
+// applyToast detects columns wal2json left out of an update because their
+// TOASTed value did not change. It reports whether the change must be
+// written as a partial update; in ToastFetch mode the values are fetched
+// instead, falling back to a partial update if the row is gone or there is
+// no database to fetch them from, as when replaying.
+func (m *MeiliSearchHandler) applyToast(change postgres.ChangeEvent) (postgres.ChangeEvent, bool, error) {
+	if change.Op != "update" {
+		return change, false, nil
+	}
+
+	missing, err := m.unchangedColumns(change)
+	if err != nil || len(missing) == 0 {
+		return change, false, err
+	}
+
+	if m.Toast != ToastFetch || m.DB == nil {
+		return change, true, nil
+	}
+
+	values, err := m.fetchColumns(change.After, missing)
+	if err != nil {
+		return change, false, err
+	}
+	if values == nil {
+		return change, true, nil
+	}
+
+	after := make(map[string]interface{}, len(change.After)+len(values))
+	for column, value := range change.After {
+		after[column] = value
+	}
+	for column, value := range values {
+		after[column] = value
+	}
+	change.After = after
+	return change, false, nil
+}
+
+// unchangedColumns returns the indexed TOAST-able columns missing from the
+// new row of an update. Without a database to read the catalog from, the
+// candidates are the columns of the old row, sent complete with REPLICA
+// IDENTITY FULL, and the configured column list.
+func (m *MeiliSearchHandler) unchangedColumns(change postgres.ChangeEvent) ([]string, error) {
+	var columns []string
+	if m.DB != nil {
+		toast, err := m.toastableColumns()
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range toast {
+			columns = append(columns, column.name)
+		}
+	} else {
+		columns = append(columns, m.Columns...)
+		for column := range change.Before {
+			if !slices.Contains(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+		slices.Sort(columns)
+	}
+
+	var missing []string
+	for _, column := range columns {
+		if len(m.Columns) > 0 && !slices.Contains(m.keyColumns(), column) && !slices.Contains(m.Columns, column) {
+			continue
+		}
+		if slices.Contains(m.IgnoreColumns, column) {
+			continue
+		}
+		if _, ok := change.After[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	return missing, nil
+}
+
+type tableColumn struct {
+	name   string
+	pgType string
+}
+
+// toastableColumns lists the variable-length columns of the table that can
+// be stored out of line. Generated columns are skipped, logical decoding
+// never sends them.
+func (m *MeiliSearchHandler) toastableColumns() ([]tableColumn, error) {
+	m.toastMu.Lock()
+	defer m.toastMu.Unlock()
+	if m.toastColumns != nil {
+		return m.toastColumns, nil
+	}
+
+	rows, err := m.DB.Query(`SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+			AND a.attlen = -1 AND a.attstorage <> 'p'
+			AND COALESCE(to_jsonb(a) ->> 'attgenerated', '') = ''
+		ORDER BY a.attnum`, postgres.ParseTableName(m.TableName).Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", m.TableName, err)
+	}
+	defer rows.Close()
+
+	columns := []tableColumn{}
+	for rows.Next() {
+		var column tableColumn
+		if err := rows.Scan(&column.name, &column.pgType); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	m.toastColumns = columns
+	return columns, nil
+}
+
+// fetchColumns reads the given columns of the row whose key is in row, in the
+// text form wal2json uses: numerics as numbers, everything else as strings.
+// It returns nil if the row no longer exists.
+func (m *MeiliSearchHandler) fetchColumns(row map[string]interface{}, columns []string) (map[string]interface{}, error) {
+
+	types := make(map[string]string)
+	toast, err := m.toastableColumns()
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range toast {
+		types[column.name] = column.pgType
+	}
+
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		quoted := pgx.Identifier{column}.Sanitize()
+		if strings.HasPrefix(types[column], "numeric") {
+			selected[i] = "t." + quoted
+		} else {
+			selected[i] = fmt.Sprintf("t.%s::text AS %s", quoted, quoted)
+		}
+	}
+
+	keyTypes, err := m.keyTypes(m.DB)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []interface{}
+	for i, column := range m.keyColumns() {
+		value, ok := row[column]
+		if !ok || value == nil {
+			return nil, fmt.Errorf("primary key %q missing from update of %s", column, m.TableName)
+		}
+		key, err := filterArg(value)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, key)
+		conditions = append(conditions, fmt.Sprintf("t.%s = $%d::text::%s", pgx.Identifier{column}.Sanitize(), len(args), keyTypes[i]))
+	}
+
+	query := fmt.Sprintf("SELECT row_to_json(r)::text FROM (SELECT %s FROM %s AS t WHERE %s) AS r",
+		strings.Join(selected, ", "), postgres.ParseTableName(m.TableName).Sanitize(), strings.Join(conditions, " AND "))
+
+	var data string
+	err = m.DB.QueryRow(query, args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unchanged columns of %s: %w", m.TableName, err)
+	}
+
+	values := make(map[string]interface{}, len(columns))
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("failed to decode unchanged columns of %s: %w", m.TableName, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,90 @@
+package meilisearch
+
+import (
+	"crypto/sha256"
+	"reflect"
+	"slices"
+	"sync"
+
+	"nats-jetstream/pkg/metrics"
+	"nats-jetstream/pkg/postgres"
+)
+
+// unchangedUpdate reports whether an update leaves every column of the row,
+// other than IgnoreColumns, as it was. It needs the old row, which Postgres
+// sends only with REPLICA IDENTITY FULL; with the default identity Before
+// holds just the key and the update counts as a change. The whole row is
+// compared, not just the indexed columns, since a column outside the
+// document, such as the one a where filter or soft-delete rule reads, can
+// still add or remove the document.
+func (m *MeiliSearchHandler) unchangedUpdate(change postgres.ChangeEvent) bool {
+	if change.Op != "update" || len(change.Before) == 0 {
+		return false
+	}
+	for column, value := range change.After {
+		if slices.Contains(m.IgnoreColumns, column) {
+			continue
+		}
+		old, ok := change.Before[column]
+		if !ok || !reflect.DeepEqual(old, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// documentHashes remembers a hash of the last payload written for each
+// document, so an update producing the same payload can be dropped without
+// the old row. It holds at most size entries and starts over when full.
+type documentHashes struct {
+	mu     sync.Mutex
+	size   int
+	hashes map[string][sha256.Size]byte
+}
+
+func documentKey(index, id string) string {
+	return index + "\x00" + id
+}
+
+// seen reports whether payload was the last one written for the document.
+func (d *documentHashes) seen(key string, payload []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hash, ok := d.hashes[key]
+	return ok && hash == sha256.Sum256(payload)
+}
+
+// remember records payload as written for the document.
+func (d *documentHashes) remember(key string, payload []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hashes == nil || len(d.hashes) >= d.size {
+		d.hashes = make(map[string][sha256.Size]byte)
+	}
+	d.hashes[key] = sha256.Sum256(payload)
+}
+
+// forget drops the document, after a delete or a partial write.
+func (d *documentHashes) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.hashes, key)
+}
+
+// documentHashes returns the handler's payload cache, or nil when
+// HashCacheSize is zero.
+func (m *MeiliSearchHandler) documentHashes() *documentHashes {
+	if m.HashCacheSize <= 0 {
+		return nil
+	}
+	m.hashesOnce.Do(func() {
+		m.hashes = &documentHashes{size: m.HashCacheSize}
+	})
+	return m.hashes
+}
+
+// skipUpdate counts an update that was dropped because it changes nothing
+// in the index.
+func skipUpdate() {
+	metrics.SkippedUpdates.Add(1)
+}
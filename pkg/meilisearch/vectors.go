@@ -0,0 +1,170 @@
+package meilisearch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"nats-jetstream/pkg/postgres"
+
+	meili "github.com/meilisearch/meilisearch-go"
+)
+
+// VectorsField is the attribute Meilisearch reads user-provided embeddings
+// from, keyed by embedder name.
+const VectorsField = "_vectors"
+
+// DefaultEmbedder is the embedder name used when a mapping names none; it is
+// also the embedder hybrid search uses by default.
+const DefaultEmbedder = "default"
+
+// userProvided is the embedder source for vectors supplied with documents.
+const userProvided = "userProvided"
+
+// VectorMapping moves a pgvector column into _vectors.<Embedder>.
+// Dimensions is read from the column type, vector(n), when left zero.
+type VectorMapping struct {
+	Column     string
+	Embedder   string
+	Dimensions int
+}
+
+func (v VectorMapping) embedder() string {
+	if v.Embedder == "" {
+		return DefaultEmbedder
+	}
+	return v.Embedder
+}
+
+// ValidateVectors checks that every mapping names a column and that no two
+// mappings share an embedder.
+func ValidateVectors(mappings []VectorMapping) error {
+	seen := make(map[string]bool, len(mappings))
+	for _, mapping := range mappings {
+		if mapping.Column == "" {
+			return fmt.Errorf("vectors entry needs a column")
+		}
+		if mapping.Dimensions < 0 {
+			return fmt.Errorf("vectors column %s has negative dimensions", mapping.Column)
+		}
+		if seen[mapping.embedder()] {
+			return fmt.Errorf("embedder %q is mapped more than once", mapping.embedder())
+		}
+		seen[mapping.embedder()] = true
+	}
+	return nil
+}
+
+// applyVectors replaces each mapped column of doc with its embedding under
+// _vectors. Columns absent from doc, as in partial updates, are skipped; a
+// null column clears the document's embedding.
+func applyVectors(mappings []VectorMapping, doc map[string]interface{}) error {
+	vectors := make(map[string]interface{}, len(mappings))
+	for _, mapping := range mappings {
+		value, ok := doc[mapping.Column]
+		if !ok {
+			continue
+		}
+		delete(doc, mapping.Column)
+		if value == nil {
+			vectors[mapping.embedder()] = nil
+			continue
+		}
+		embedding, err := parseVector(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode vector column %s: %w", mapping.Column, err)
+		}
+		vectors[mapping.embedder()] = embedding
+	}
+	if len(vectors) > 0 {
+		doc[VectorsField] = vectors
+	}
+	return nil
+}
+
+// parseVector reads pgvector's text form, [0.1,0.2,...].
+func parseVector(value interface{}) ([]float64, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	case []interface{}:
+		embedding := make([]float64, len(v))
+		for i, item := range v {
+			f, err := geoNumber(item)
+			if err != nil {
+				return nil, err
+			}
+			embedding[i] = f
+		}
+		return embedding, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v (%T)", value, value)
+	}
+
+	var embedding []float64
+	if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &embedding); err != nil {
+		return nil, fmt.Errorf("%q is not a vector: %v", text, err)
+	}
+	return embedding, nil
+}
+
+// ensureEmbedders declares a userProvided embedder for every mapping whose
+// embedder is missing from the index or has other dimensions. Embedders
+// not mapped by the table are left alone.
+func (m *MeiliSearchHandler) ensureEmbedders(uid string, l *log.Logger) error {
+	index := m.Client.Index(uid)
+	current, err := index.GetEmbedders()
+	if err != nil {
+		return fmt.Errorf("failed to get embedders: %v", err)
+	}
+
+	updates := make(map[string]meili.Embedder)
+	for _, mapping := range m.Vectors {
+		dimensions := mapping.Dimensions
+		if dimensions == 0 {
+			if dimensions, err = m.vectorDimensions(m.DB, mapping.Column); err != nil {
+				return err
+			}
+		}
+		embedder, ok := current[mapping.embedder()]
+		if ok && embedder.Source == userProvided && embedder.Dimensions == dimensions {
+			continue
+		}
+		updates[mapping.embedder()] = meili.Embedder{Source: userProvided, Dimensions: dimensions}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	if _, err := index.UpdateEmbedders(updates); err != nil {
+		return fmt.Errorf("failed to update embedders: %v", err)
+	}
+	for name, embedder := range updates {
+		l.Printf("Declared embedder %q (%s, %d dimensions) on index %q", name, userProvided, embedder.Dimensions, uid)
+	}
+	return nil
+}
+
+// vectorDimensions reads n from the column's vector(n) type.
+func (m *MeiliSearchHandler) vectorDimensions(db *sql.DB, column string) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("dimensions of %s.%s are not configured and no database connection is available", m.TableName, column)
+	}
+	var dimensions int
+	err := db.QueryRow(
+		"SELECT atttypmod FROM pg_attribute WHERE attrelid = $1::regclass AND attname = $2 AND NOT attisdropped",
+		postgres.ParseTableName(m.TableName).Sanitize(), column,
+	).Scan(&dimensions)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up type of %s.%s: %v", m.TableName, column, err)
+	}
+	if dimensions <= 0 {
+		return 0, fmt.Errorf("column %s.%s has no fixed dimensions; set dimensions in its vectors entry", m.TableName, column)
+	}
+	return dimensions, nil
+}
@@ -0,0 +1,29 @@
+// Package metrics exposes process counters through expvar, served as JSON
+// at /debug/vars.
+package metrics
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+var (
+	NATSConnected   = expvar.NewInt("nats_connected")
+	NATSDisconnects = expvar.NewInt("nats_disconnects_total")
+	NATSReconnects  = expvar.NewInt("nats_reconnects_total")
+	NATSErrors      = expvar.NewInt("nats_async_errors_total")
+
+	// SkippedUpdates counts updates dropped because no indexed field changed.
+	SkippedUpdates = expvar.NewInt("meilisearch_skipped_updates_total")
+)
+
+// Serve exposes the counters on addr in the background.
+func Serve(addr string, l *log.Logger) {
+	go func() {
+		l.Printf("Serving metrics on %s/debug/vars", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			l.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
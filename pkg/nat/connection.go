@@ -1,12 +1,20 @@
 package nat
 
 import (
+	"fmt"
 	"log"
 	"time"
 
+	"nats-jetstream/pkg/metrics"
+
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	defaultMaxReconnects = 10
+	defaultReconnectWait = time.Second
+)
+
 func (nc *NATSConnectionImpl) JetStream(options ...nats.JSOpt) (JetStreamContext, error) {
 	js, err := nc.Conn.JetStream(options...)
 	if err != nil {
@@ -24,10 +32,12 @@ func (nc *NATSConnectionImpl) GetConn() *nats.Conn {
 }
 
 func (uc *URLConnector) Connect(enableLogging bool) (NATSConnection, JetStreamContext, error) {
-	nc, err := nats.Connect(uc.URL, nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(10),
-		nats.ReconnectWait(time.Second),
-		nats.ReconnectHandler(func(_ *nats.Conn) {}))
+	opts, err := uc.options()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc, err := nats.Connect(uc.URL, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -38,9 +48,91 @@ func (uc *URLConnector) Connect(enableLogging bool) (NATSConnection, JetStreamCo
 		return nil, nil, err
 	}
 
-	if enableLogging {
-		log.Println("Connected to NATS with JetStream enabled at", uc.URL)
+	// With RetryOnFailedConnect the first connection may still be pending;
+	// ConnectHandler reports it once established.
+	if nc.IsConnected() {
+		metrics.NATSConnected.Set(1)
+		if enableLogging {
+			log.Println("Connected to NATS with JetStream enabled at", nc.ConnectedUrlRedacted())
+		}
 	}
 
 	return &NATSConnectionImpl{Conn: nc}, &JetStreamContextImpl{JS: js}, nil
 }
+
+func (uc *URLConnector) options() ([]nats.Option, error) {
+	logger := uc.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	maxReconnects := uc.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = defaultMaxReconnects
+	}
+	reconnectWait := uc.ReconnectWait
+	if reconnectWait <= 0 {
+		reconnectWait = defaultReconnectWait
+	}
+
+	opts := []nats.Option{
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(reconnectWait),
+		nats.ReconnectJitter(uc.ReconnectJitter, uc.ReconnectJitter),
+		nats.ConnectHandler(func(c *nats.Conn) {
+			metrics.NATSConnected.Set(1)
+			logger.Printf("NATS connected to %s", c.ConnectedUrlRedacted())
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			metrics.NATSConnected.Set(0)
+			metrics.NATSDisconnects.Add(1)
+			logger.Printf("NATS disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			metrics.NATSConnected.Set(1)
+			metrics.NATSReconnects.Add(1)
+			logger.Printf("NATS reconnected to %s", c.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(c *nats.Conn) {
+			metrics.NATSConnected.Set(0)
+			if err := c.LastError(); err != nil {
+				logger.Printf("NATS connection closed: %v", err)
+				return
+			}
+			logger.Println("NATS connection closed")
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			metrics.NATSErrors.Add(1)
+			if sub != nil {
+				logger.Printf("NATS error on subject %s: %v", sub.Subject, err)
+				return
+			}
+			logger.Printf("NATS error: %v", err)
+		}),
+	}
+
+	switch {
+	case uc.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(uc.CredsFile))
+	case uc.NKeyFile != "":
+		opt, err := nats.NkeyOptionFromSeed(uc.NKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NKey seed: %w", err)
+		}
+		opts = append(opts, opt)
+	case uc.User != "":
+		opts = append(opts, nats.UserInfo(uc.User, uc.Password))
+	case uc.Token != "":
+		opts = append(opts, nats.Token(uc.Token))
+	}
+
+	if uc.TLSCAFile != "" {
+		opts = append(opts, nats.RootCAs(uc.TLSCAFile))
+	}
+	if uc.TLSCertFile != "" || uc.TLSKeyFile != "" {
+		opts = append(opts, nats.ClientCert(uc.TLSCertFile, uc.TLSKeyFile))
+	}
+
+	return opts, nil
+}
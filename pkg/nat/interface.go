@@ -2,6 +2,10 @@ package nat
 
 import (
 	"log"
+	"sync"
+	"time"
+
+	"nats-jetstream/pkg/checkpoint"
 
 	"github.com/nats-io/nats.go"
 )
@@ -28,6 +32,7 @@ type JetStreamContext interface {
 	Publish(subject string, data []byte, opts ...nats.PubOpt) (*nats.PubAck, error)
 	SubscribeSync(subj string, opts ...nats.SubOpt) (*nats.Subscription, error)
 	Subscribe(subj string, cb nats.MsgHandler, opts ...nats.SubOpt) (*nats.Subscription, error)
+	PullSubscribe(subj, durable string, opts ...nats.SubOpt) (*nats.Subscription, error)
 	PublishAsync(subject string, data []byte, opts ...nats.PubOpt) (nats.PubAckFuture, error)
 }
 
@@ -37,12 +42,79 @@ type JetStreamContextImpl struct {
 
 type URLConnector struct {
 	URL string
+
+	// Authentication; at most one of CredsFile, NKeyFile, User/Password
+	// and Token is normally set.
+	CredsFile string
+	NKeyFile  string
+	User      string
+	Password  string
+	Token     string
+
+	// TLS with a custom CA and/or a client certificate.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// MaxReconnects of 0 means the default of 10, -1 retries forever.
+	MaxReconnects   int
+	ReconnectWait   time.Duration
+	ReconnectJitter time.Duration
+
+	// Logger receives connection events; nil means the standard logger.
+	Logger *log.Logger
 }
 
 type SubscriptionManagerImpl struct {
 	JetStream JetStreamContext
+	// StreamName and Checkpoints, when set, let a lost durable consumer be
+	// recreated right after the last sequence it applied.
+	StreamName  string
+	Checkpoints checkpoint.Store
+
+	mu           sync.Mutex
+	lastSequence uint64
+
+	// inflight holds the deferred batches in fetch order, so a batch is
+	// acknowledged and checkpointed only once it and every batch before it
+	// were applied.
+	inflightMu   sync.Mutex
+	inflight     []*inflightBatch
+	inflightCond *sync.Cond
+}
+
+type inflightBatch struct {
+	msgs     []*nats.Msg
+	batch    [][]byte
+	finished bool
+	err      error
 }
 
 type MessageHandler interface {
 	HandleMessage([]byte, *log.Logger) error
 }
+
+// BatchMessageHandler handles every message of a pull fetch in one call, so
+// the whole batch can be written to Meilisearch as a single request.
+type BatchMessageHandler interface {
+	HandleBatch([][]byte, *log.Logger) error
+}
+
+// DeferredBatchHandler handles a batch that may be applied after the call
+// returns, such as changes held for a coalescing window. done is called once
+// with the outcome, when every message of the batch is applied. Fetching goes
+// on meanwhile; the batch is acknowledged once it and the batches fetched
+// before it are applied. After a failure nothing more is fetched until the
+// failed batch, and the ones after it, are applied again with HandleBatch.
+type DeferredBatchHandler interface {
+	HandleBatchDeferred(batch [][]byte, l *log.Logger, done func(error))
+}
+
+// PullOptions tunes a pull consumer. Zero values fall back to the defaults
+// below.
+type PullOptions struct {
+	BatchSize     int
+	MaxAckPending int
+	FetchTimeout  time.Duration
+	AckWait       time.Duration
+}
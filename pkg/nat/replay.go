@@ -0,0 +1,100 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/nats-io/nats.go"
+)
+
+const defaultReplayIdleTimeout = 5 * time.Second
+
+// ReplayOptions selects the part of the stream to replay. StartSequence wins
+// over StartTime; with neither set the whole stream is replayed.
+type ReplayOptions struct {
+	StartSequence uint64
+	StartTime     time.Time
+	// Tables limits the replay to these tables, given as schema.table or as a
+	// bare table name. Empty means every table.
+	Tables []string
+	// IdleTimeout ends the replay when no message arrives for this long.
+	IdleTimeout time.Duration
+}
+
+// Replay reads subject through an ephemeral ordered consumer and passes every
+// message of a selected table to handler, until it has caught up with the end
+// of the stream. It returns the number of messages applied.
+func (sm *SubscriptionManagerImpl) Replay(ctx context.Context, subject string, opts ReplayOptions, handler MessageHandler, logger *log.Logger) (int, error) {
+	subOpts := []nats.SubOpt{nats.OrderedConsumer()}
+	switch {
+	case opts.StartSequence > 0:
+		subOpts = append(subOpts, nats.StartSequence(opts.StartSequence))
+	case !opts.StartTime.IsZero():
+		subOpts = append(subOpts, nats.StartTime(opts.StartTime))
+	default:
+		subOpts = append(subOpts, nats.DeliverAll())
+	}
+
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultReplayIdleTimeout
+	}
+
+	sub, err := sm.JetStream.SubscribeSync(subject, subOpts...)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+
+	logger.Printf("Replaying subject %s", subject)
+
+	applied := 0
+	for {
+		nextCtx, cancel := context.WithTimeout(ctx, idleTimeout)
+		msg, err := sub.NextMsgWithContext(nextCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				logger.Printf("No more messages on subject %s, replay finished", subject)
+				return applied, nil
+			}
+			return applied, err
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return applied, fmt.Errorf("failed to read message metadata: %w", err)
+		}
+
+		if replayTableSelected(msg.Header.Get(postgres.HeaderTable), opts.Tables) {
+			if err := handler.HandleMessage(msg.Data, logger); err != nil {
+				return applied, fmt.Errorf("failed to apply stream sequence %d: %w", meta.Sequence.Stream, err)
+			}
+			applied++
+		}
+
+		if meta.NumPending == 0 {
+			logger.Printf("Replay caught up at stream sequence %d", meta.Sequence.Stream)
+			return applied, nil
+		}
+	}
+}
+
+func replayTableSelected(table string, tables []string) bool {
+	if len(tables) == 0 {
+		return true
+	}
+	_, bare, _ := strings.Cut(table, ".")
+	for _, selected := range tables {
+		if selected == table || selected == bare {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package nat
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+const embeddedServerReadyTimeout = 10 * time.Second
+
+// EmbeddedServerOptions configures the in-process NATS server.
+type EmbeddedServerOptions struct {
+	// StoreDir is where JetStream keeps streams on disk.
+	StoreDir string
+	Host     string
+	// Port is the client port. A negative port serves in-process
+	// connections only.
+	Port int
+}
+
+// EmbeddedConnector connects to a NATS server running in this process.
+type EmbeddedConnector struct {
+	Server *server.Server
+}
+
+// StartEmbeddedServer starts a JetStream-enabled NATS server inside the
+// process and waits until it accepts connections.
+func StartEmbeddedServer(opts EmbeddedServerOptions, logger *log.Logger) (*server.Server, error) {
+	ns, err := server.NewServer(&server.Options{
+		ServerName: "syncmeilisearch",
+		JetStream:  true,
+		StoreDir:   opts.StoreDir,
+		Host:       opts.Host,
+		Port:       opts.Port,
+		DontListen: opts.Port < 0,
+		NoSigs:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedded NATS server: %w", err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(embeddedServerReadyTimeout) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("embedded NATS server not ready after %s", embeddedServerReadyTimeout)
+	}
+
+	logger.Printf("Embedded NATS server started with JetStream store at %s", opts.StoreDir)
+	return ns, nil
+}
+
+func (ec *EmbeddedConnector) Connect(enableLogging bool) (NATSConnection, JetStreamContext, error) {
+	nc, err := nats.Connect(ec.Server.ClientURL(), nats.InProcessServer(ec.Server))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	if enableLogging {
+		log.Println("Connected to embedded NATS server with JetStream enabled")
+	}
+
+	return &NATSConnectionImpl{Conn: nc}, &JetStreamContextImpl{JS: js}, nil
+}
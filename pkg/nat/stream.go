@@ -1,6 +1,10 @@
 package nat
 
-import "github.com/nats-io/nats.go"
+import (
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
 
 func (js *JetStreamContextImpl) StreamInfo(name string) (*nats.StreamInfo, error) {
 	return js.JS.StreamInfo(name)
@@ -9,3 +13,28 @@ func (js *JetStreamContextImpl) StreamInfo(name string) (*nats.StreamInfo, error
 func (js *JetStreamContextImpl) AddStream(cfg *nats.StreamConfig) (*nats.StreamInfo, error) {
 	return js.JS.AddStream(cfg)
 }
+
+// SetupStream creates a file-backed stream capturing subject unless a stream
+// with that name already exists.
+func (sm *SubscriptionManagerImpl) SetupStream(streamName, subject string) error {
+	_, err := sm.JetStream.StreamInfo(streamName)
+	if err == nil {
+		log.Printf("Stream %s already exists", streamName)
+		return nil
+	}
+	if err != nats.ErrStreamNotFound {
+		return err
+	}
+
+	_, err = sm.JetStream.AddStream(&nats.StreamConfig{
+		Name:     streamName,
+		Subjects: []string{subject},
+		Storage:  nats.FileStorage,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Stream %s is ready", streamName)
+
+	return nil
+}
@@ -1,11 +1,25 @@
 package nat
 
 import (
+	"context"
+	"errors"
 	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"nats-jetstream/pkg/checkpoint"
 
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	defaultPullBatchSize     = 100
+	defaultPullMaxAckPending = 1000
+	defaultPullFetchTimeout  = 5 * time.Second
+	defaultPullAckWait       = 30 * time.Second
+)
+
 func (js *JetStreamContextImpl) SubscribeSync(subj string, opts ...nats.SubOpt) (*nats.Subscription, error) {
 	return js.JS.SubscribeSync(subj, opts...)
 }
@@ -14,6 +28,10 @@ func (js *JetStreamContextImpl) Subscribe(subj string, cb nats.MsgHandler, opts
 	return js.JS.Subscribe(subj, cb, opts...)
 }
 
+func (js *JetStreamContextImpl) PullSubscribe(subj, durable string, opts ...nats.SubOpt) (*nats.Subscription, error) {
+	return js.JS.PullSubscribe(subj, durable, opts...)
+}
+
 func (sm *SubscriptionManagerImpl) SubscribeToSubject(subject, durableName string) (*nats.Subscription, error) {
 	sub, err := sm.JetStream.SubscribeSync(subject, nats.Durable(durableName))
 	if err != nil {
@@ -24,16 +42,276 @@ func (sm *SubscriptionManagerImpl) SubscribeToSubject(subject, durableName strin
 }
 
 func (sm *SubscriptionManagerImpl) SubscribeAsyncWithHandler(subject, durableName string, handler MessageHandler, logger *log.Logger) error {
+	opts := append([]nats.SubOpt{nats.Durable(durableName), nats.ManualAck()}, sm.resumeOptions(durableName, logger)...)
+
 	_, err := sm.JetStream.Subscribe(subject, func(msg *nats.Msg) {
 		logger.Printf("Received message: %s", string(msg.Data))
 
 		err := handler.HandleMessage(msg.Data, logger)
 		if err != nil {
 			logger.Printf("Error handling message: %v", err)
+		} else {
+			sm.saveSequence(durableName, []*nats.Msg{msg}, logger)
 		}
 
 		msg.Ack()
-	}, nats.Durable(durableName), nats.ManualAck())
+	}, opts...)
 
 	return err
 }
+
+// PullSubscribeWithBatchHandler binds a durable pull consumer to subject and
+// keeps fetching up to opts.BatchSize messages at a time until ctx is done.
+// Every instance using the same durable name shares the consumer, so the
+// server spreads batches across them and never has more than
+// opts.MaxAckPending messages outstanding.
+func (sm *SubscriptionManagerImpl) PullSubscribeWithBatchHandler(ctx context.Context, subject, durableName string, opts PullOptions, handler BatchMessageHandler, logger *log.Logger) error {
+	opts = opts.withDefaults()
+
+	subOpts := append([]nats.SubOpt{
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxAckPending(opts.MaxAckPending),
+		nats.AckWait(opts.AckWait),
+	}, sm.resumeOptions(durableName, logger)...)
+
+	sub, err := sm.JetStream.PullSubscribe(subject, durableName, subOpts...)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Pull subscribed to subject %s with durable %s (batch %d, max ack pending %d)", subject, durableName, opts.BatchSize, opts.MaxAckPending)
+
+	go sm.fetchBatches(ctx, sub, durableName, opts, handler, logger)
+
+	return nil
+}
+
+func (sm *SubscriptionManagerImpl) fetchBatches(ctx context.Context, sub *nats.Subscription, durableName string, opts PullOptions, handler BatchMessageHandler, logger *log.Logger) {
+	for ctx.Err() == nil {
+		if failed := sm.failedBatches(); failed != nil {
+			sm.retryBatches(ctx, durableName, failed, opts, handler, logger)
+			continue
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, opts.FetchTimeout)
+		msgs, err := sub.Fetch(opts.BatchSize, nats.Context(fetchCtx))
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) || ctx.Err() != nil {
+				continue
+			}
+			logger.Printf("Error fetching messages: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		batch := make([][]byte, len(msgs))
+		for i, msg := range msgs {
+			batch[i] = msg.Data
+		}
+
+		if deferred, ok := handler.(DeferredBatchHandler); ok {
+			pending := sm.startBatch(msgs, batch)
+			deferred.HandleBatchDeferred(batch, logger, func(err error) {
+				sm.finishBatch(durableName, pending, err, logger)
+			})
+			continue
+		}
+
+		if err := handler.HandleBatch(batch, logger); err != nil {
+			logger.Printf("Error handling batch of %d messages: %v", len(msgs), err)
+			sm.retryBatches(ctx, durableName, []*inflightBatch{{msgs: msgs, batch: batch}}, opts, handler, logger)
+			continue
+		}
+
+		sm.saveSequence(durableName, msgs, logger)
+
+		for _, msg := range msgs {
+			msg.Ack()
+		}
+	}
+}
+
+// startBatch records a deferred batch as in flight.
+func (sm *SubscriptionManagerImpl) startBatch(msgs []*nats.Msg, batch [][]byte) *inflightBatch {
+	sm.inflightMu.Lock()
+	defer sm.inflightMu.Unlock()
+	pending := &inflightBatch{msgs: msgs, batch: batch}
+	sm.inflight = append(sm.inflight, pending)
+	return pending
+}
+
+// finishBatch records the outcome of a deferred batch, then acknowledges and
+// checkpoints the applied batches no unfinished or failed batch precedes.
+// A failed batch stays in flight, holding back the batches after it until
+// fetchBatches retries it.
+func (sm *SubscriptionManagerImpl) finishBatch(durableName string, pending *inflightBatch, err error, logger *log.Logger) {
+	if err != nil {
+		logger.Printf("Error handling batch of %d messages: %v", len(pending.msgs), err)
+	}
+
+	sm.inflightMu.Lock()
+	pending.finished, pending.err = true, err
+	var ready []*nats.Msg
+	for len(sm.inflight) > 0 && sm.inflight[0].finished && sm.inflight[0].err == nil {
+		ready = append(ready, sm.inflight[0].msgs...)
+		sm.inflight = sm.inflight[1:]
+	}
+	sm.inflightChanged().Broadcast()
+	sm.inflightMu.Unlock()
+
+	if len(ready) > 0 {
+		sm.saveSequence(durableName, ready, logger)
+		for _, msg := range ready {
+			msg.Ack()
+		}
+	}
+}
+
+// failedBatches returns nil while the oldest batch in flight has not failed.
+// Otherwise it waits for the batches after it to finish and returns them
+// all, taken out of flight, in fetch order.
+func (sm *SubscriptionManagerImpl) failedBatches() []*inflightBatch {
+	sm.inflightMu.Lock()
+	defer sm.inflightMu.Unlock()
+	if len(sm.inflight) == 0 || !sm.inflight[0].finished || sm.inflight[0].err == nil {
+		return nil
+	}
+
+	for {
+		finished := true
+		for _, pending := range sm.inflight {
+			finished = finished && pending.finished
+		}
+		if finished {
+			break
+		}
+		sm.inflightChanged().Wait()
+	}
+
+	failed := sm.inflight
+	sm.inflight = nil
+	return failed
+}
+
+// inflightChanged returns the condition signalled when a batch finishes. The
+// caller holds inflightMu.
+func (sm *SubscriptionManagerImpl) inflightChanged() *sync.Cond {
+	if sm.inflightCond == nil {
+		sm.inflightCond = sync.NewCond(&sm.inflightMu)
+	}
+	return sm.inflightCond
+}
+
+// retryBatches applies batches again in fetch order until each succeeds,
+// acknowledging and checkpointing them one by one. Nothing else is fetched
+// meanwhile. Batches after the failed one are applied again even when they
+// succeeded, so the index ends up with their newer rows rather than the
+// older ones of the retried batch. The messages are kept in progress, so the
+// server does not redeliver them while the retries go on.
+func (sm *SubscriptionManagerImpl) retryBatches(ctx context.Context, durableName string, batches []*inflightBatch, opts PullOptions, handler BatchMessageHandler, logger *log.Logger) {
+	backoff := time.Second
+	for i, pending := range batches {
+		for {
+			for _, later := range batches[i:] {
+				for _, msg := range later.msgs {
+					msg.InProgress()
+				}
+			}
+
+			err := handler.HandleBatch(pending.batch, logger)
+			if err == nil {
+				break
+			}
+			logger.Printf("Retrying batch of %d messages in %s: %v", len(pending.msgs), backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, opts.AckWait/2)
+		}
+
+		sm.saveSequence(durableName, pending.msgs, logger)
+		for _, msg := range pending.msgs {
+			msg.Ack()
+		}
+	}
+}
+
+// resumeOptions returns the start option for a durable that no longer exists
+// but has a checkpoint, so it resumes after the last applied sequence instead
+// of replaying the whole stream.
+func (sm *SubscriptionManagerImpl) resumeOptions(durableName string, logger *log.Logger) []nats.SubOpt {
+	if sm.Checkpoints == nil || sm.StreamName == "" {
+		return nil
+	}
+
+	if _, err := sm.JetStream.ConsumerInfo(sm.StreamName, durableName); !errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil
+	}
+
+	value, ok, err := sm.Checkpoints.Load(context.Background(), checkpoint.ConsumerKey(durableName))
+	if err != nil {
+		logger.Printf("Failed to load checkpoint for durable %s: %v", durableName, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	sequence, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		logger.Printf("Invalid checkpoint %q for durable %s", value, durableName)
+		return nil
+	}
+
+	logger.Printf("Durable %s not found, recreating it from stream sequence %d", durableName, sequence+1)
+	return []nats.SubOpt{nats.StartSequence(sequence + 1)}
+}
+
+// saveSequence records the highest stream sequence applied so far.
+func (sm *SubscriptionManagerImpl) saveSequence(durableName string, msgs []*nats.Msg, logger *log.Logger) {
+	if sm.Checkpoints == nil {
+		return
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	highest := sm.lastSequence
+	for _, msg := range msgs {
+		if meta, err := msg.Metadata(); err == nil && meta.Sequence.Stream > highest {
+			highest = meta.Sequence.Stream
+		}
+	}
+	if highest == sm.lastSequence {
+		return
+	}
+
+	if err := sm.Checkpoints.Save(context.Background(), checkpoint.ConsumerKey(durableName), strconv.FormatUint(highest, 10)); err != nil {
+		logger.Printf("Failed to save checkpoint for durable %s: %v", durableName, err)
+		return
+	}
+	sm.lastSequence = highest
+}
+
+func (o PullOptions) withDefaults() PullOptions {
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultPullBatchSize
+	}
+	if o.MaxAckPending <= 0 {
+		o.MaxAckPending = defaultPullMaxAckPending
+	}
+	if o.FetchTimeout <= 0 {
+		o.FetchTimeout = defaultPullFetchTimeout
+	}
+	if o.AckWait <= 0 {
+		o.AckWait = defaultPullAckWait
+	}
+	return o
+}
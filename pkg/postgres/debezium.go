@@ -0,0 +1,349 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output formats of the published change events.
+const (
+	FormatEnvelope = "envelope"
+	FormatDebezium = "debezium"
+)
+
+const debeziumVersion = "2.7.0.Final"
+
+// DebeziumEvent mirrors the change-event value emitted by Debezium's
+// Postgres connector with the JSON converter and schemas enabled.
+type DebeziumEvent struct {
+	Schema  DebeziumSchema  `json:"schema"`
+	Payload DebeziumPayload `json:"payload"`
+}
+
+// DebeziumKey mirrors the record key Debezium sends next to the value. A
+// JetStream message has no separate key, so it is published in the
+// HeaderKey header and the value stays exactly {schema, payload}.
+type DebeziumKey struct {
+	Schema  DebeziumSchema         `json:"schema"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// DebeziumSchema describes a struct or a single field of a Debezium schema.
+type DebeziumSchema struct {
+	Type     string           `json:"type"`
+	Fields   []DebeziumSchema `json:"fields,omitempty"`
+	Optional bool             `json:"optional"`
+	Name     string           `json:"name,omitempty"`
+	Field    string           `json:"field,omitempty"`
+}
+
+type DebeziumPayload struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source DebeziumSource         `json:"source"`
+	Op     string                 `json:"op"`
+	TsMs   int64                  `json:"ts_ms"`
+}
+
+type DebeziumSource struct {
+	Version   string `json:"version"`
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+	DB        string `json:"db"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	TxID      uint32 `json:"txId"`
+	LSN       uint64 `json:"lsn"`
+}
+
+var debeziumOps = map[string]string{
+	"insert": "c",
+	"update": "u",
+	"delete": "d",
+}
+
+// EncodeEvent encodes event in the given output format. An empty format
+// means FormatEnvelope.
+func EncodeEvent(event ChangeEvent, format string) ([]byte, error) {
+	switch format {
+	case "", FormatEnvelope:
+		return json.Marshal(event)
+	case FormatDebezium:
+		return json.Marshal(ToDebezium(event))
+	default:
+		return nil, fmt.Errorf("unknown event format: %s", format)
+	}
+}
+
+// EncodeKey encodes the key columns of event for the HeaderKey header: the
+// pk object for FormatEnvelope, a DebeziumKey for FormatDebezium. It returns
+// nil when the event has no key.
+func EncodeKey(event ChangeEvent, format string) ([]byte, error) {
+	if len(event.PK) == 0 {
+		return nil, nil
+	}
+	switch format {
+	case "", FormatEnvelope:
+		return json.Marshal(event.PK)
+	case FormatDebezium:
+		types := make(map[string]string, len(event.PK))
+		for column := range event.PK {
+			types[column] = event.Types[column]
+		}
+		schema := debeziumValueSchema(fmt.Sprintf("%s.%s.%s.Key", Database, event.Schema, event.Table), types)
+		schema.Optional = false
+		for i := range schema.Fields {
+			schema.Fields[i].Optional = false
+		}
+		return json.Marshal(DebeziumKey{Schema: schema, Payload: toDebeziumRow(event.PK, event.Types)})
+	default:
+		return nil, fmt.Errorf("unknown event format: %s", format)
+	}
+}
+
+// ToDebezium converts a change event into a Debezium change event. Column
+// types are mapped the way the Debezium connector maps them with
+// decimal.handling.mode=double, and values are written in the JSON type
+// their schema declares.
+func ToDebezium(event ChangeEvent) DebeziumEvent {
+	lsn, _ := ParseLSN(event.LSN)
+	commitMs := event.CommitTime.UnixMilli()
+	if event.CommitTime.IsZero() {
+		commitMs = 0
+	}
+
+	var before, after map[string]interface{}
+	if event.Before != nil {
+		before = toDebeziumRow(event.Before, event.Types)
+	}
+	if event.After != nil {
+		after = toDebeziumRow(event.After, event.Types)
+	}
+
+	recordName := fmt.Sprintf("%s.%s.%s", Database, event.Schema, event.Table)
+	value := debeziumValueSchema(recordName+".Value", event.Types)
+	beforeSchema, afterSchema := value, value
+	beforeSchema.Field, afterSchema.Field = "before", "after"
+
+	return DebeziumEvent{
+		Schema: DebeziumSchema{
+			Type: "struct",
+			Name: recordName + ".Envelope",
+			Fields: []DebeziumSchema{
+				beforeSchema,
+				afterSchema,
+				debeziumSourceSchema(),
+				{Type: "string", Field: "op"},
+				{Type: "int64", Optional: true, Field: "ts_ms"},
+			},
+		},
+		Payload: DebeziumPayload{
+			Before: before,
+			After:  after,
+			Source: DebeziumSource{
+				Version:   debeziumVersion,
+				Connector: "postgresql",
+				Name:      Database,
+				TsMs:      commitMs,
+				Snapshot:  "false",
+				DB:        Database,
+				Schema:    event.Schema,
+				Table:     event.Table,
+				TxID:      event.XID,
+				LSN:       uint64(lsn),
+			},
+			Op:   debeziumOps[event.Op],
+			TsMs: time.Now().UnixMilli(),
+		},
+	}
+}
+
+// FromDebezium converts a Debezium change event back into a change event,
+// undoing the temporal conversions done by ToDebezium.
+func FromDebezium(dbz DebeziumEvent) (ChangeEvent, error) {
+	event := ChangeEvent{
+		Schema: dbz.Payload.Source.Schema,
+		Table:  dbz.Payload.Source.Table,
+		LSN:    LSN(dbz.Payload.Source.LSN).String(),
+		XID:    dbz.Payload.Source.TxID,
+	}
+	if dbz.Payload.Source.TsMs > 0 {
+		event.CommitTime = time.UnixMilli(dbz.Payload.Source.TsMs).UTC()
+	}
+
+	switch dbz.Payload.Op {
+	case "c", "r":
+		event.Op = "insert"
+	case "u":
+		event.Op = "update"
+	case "d":
+		event.Op = "delete"
+	default:
+		return event, fmt.Errorf("unknown debezium op: %q", dbz.Payload.Op)
+	}
+
+	names := make(map[string]string)
+	for _, field := range dbz.Schema.Fields {
+		if field.Field == "after" || field.Field == "before" {
+			for _, column := range field.Fields {
+				names[column.Field] = column.Name
+			}
+		}
+	}
+
+	if dbz.Payload.Before != nil {
+		event.Before = fromDebeziumRow(dbz.Payload.Before, names)
+	}
+	if dbz.Payload.After != nil {
+		event.After = fromDebeziumRow(dbz.Payload.After, names)
+	}
+
+	return event, nil
+}
+
+func debeziumSourceSchema() DebeziumSchema {
+	return DebeziumSchema{
+		Type:  "struct",
+		Name:  "io.debezium.connector.postgresql.Source",
+		Field: "source",
+		Fields: []DebeziumSchema{
+			{Type: "string", Field: "version"},
+			{Type: "string", Field: "connector"},
+			{Type: "string", Field: "name"},
+			{Type: "int64", Field: "ts_ms"},
+			{Type: "string", Optional: true, Name: "io.debezium.data.Enum", Field: "snapshot"},
+			{Type: "string", Field: "db"},
+			{Type: "string", Field: "schema"},
+			{Type: "string", Field: "table"},
+			{Type: "int64", Optional: true, Field: "txId"},
+			{Type: "int64", Optional: true, Field: "lsn"},
+		},
+	}
+}
+
+func debeziumValueSchema(name string, types map[string]string) DebeziumSchema {
+	columns := make([]string, 0, len(types))
+	for column := range types {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	schema := DebeziumSchema{Type: "struct", Name: name, Optional: true}
+	for _, column := range columns {
+		fieldType, fieldName := debeziumType(types[column])
+		schema.Fields = append(schema.Fields, DebeziumSchema{
+			Type:     fieldType,
+			Name:     fieldName,
+			Optional: true,
+			Field:    column,
+		})
+	}
+	return schema
+}
+
+// debeziumType maps a Postgres type to a Debezium field type and semantic
+// type name.
+func debeziumType(pgType string) (string, string) {
+	if i := strings.IndexByte(pgType, '('); i >= 0 {
+		pgType = pgType[:i]
+	}
+	switch strings.TrimSpace(pgType) {
+	case "smallint", "int2":
+		return "int16", ""
+	case "integer", "int", "int4", "serial":
+		return "int32", ""
+	case "bigint", "int8", "bigserial":
+		return "int64", ""
+	case "real", "float4":
+		return "float", ""
+	case "double precision", "float8", "numeric", "decimal":
+		return "double", ""
+	case "oid":
+		return "int64", ""
+	case "boolean", "bool":
+		return "boolean", ""
+	case "bytea":
+		return "bytes", ""
+	case "date":
+		return "int32", "io.debezium.time.Date"
+	case "timestamp", "timestamp without time zone":
+		return "int64", "io.debezium.time.MicroTimestamp"
+	case "timestamptz", "timestamp with time zone":
+		return "string", "io.debezium.time.ZonedTimestamp"
+	case "uuid":
+		return "string", "io.debezium.data.Uuid"
+	case "json", "jsonb":
+		return "string", "io.debezium.data.Json"
+	default:
+		return "string", ""
+	}
+}
+
+func toDebeziumRow(row map[string]interface{}, types map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		fieldType, name := debeziumType(types[column])
+		out[column] = toDebeziumValue(value, fieldType, name)
+	}
+	return out
+}
+
+func toDebeziumValue(value interface{}, fieldType, name string) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		// A string field, such as one of a type without a mapping, holds
+		// the value as text.
+		if fieldType == "string" && value != nil {
+			if data, err := json.Marshal(value); err == nil {
+				return string(data)
+			}
+		}
+		return value
+	}
+	switch name {
+	case "io.debezium.time.Date":
+		if t, err := time.Parse("2006-01-02", text); err == nil {
+			return t.Unix() / 86400
+		}
+	case "io.debezium.time.MicroTimestamp":
+		if t, err := time.Parse("2006-01-02 15:04:05.999999", text); err == nil {
+			return t.UnixMicro()
+		}
+	case "io.debezium.time.ZonedTimestamp":
+		if t, err := parseWAL2JSONTimestamp(text); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
+
+func fromDebeziumRow(row map[string]interface{}, names map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		out[column] = fromDebeziumValue(value, names[column])
+	}
+	return out
+}
+
+func fromDebeziumValue(value interface{}, name string) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	n, err := number.Int64()
+	if err != nil {
+		return value
+	}
+	switch name {
+	case "io.debezium.time.Date":
+		return time.Unix(n*86400, 0).UTC().Format("2006-01-02")
+	case "io.debezium.time.MicroTimestamp":
+		return time.UnixMicro(n).UTC().Format("2006-01-02 15:04:05.999999")
+	}
+	return value
+}
@@ -0,0 +1,207 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS headers set on every published change event, so consumers can route
+// and filter without decoding the body.
+const (
+	HeaderTable = "Sync-Table"
+	HeaderOp    = "Sync-Op"
+	HeaderLSN   = "Sync-Lsn"
+	// HeaderKey holds the key columns of the row, encoded by EncodeKey.
+	HeaderKey = "Sync-Key"
+)
+
+// ChangeEvent is the envelope published for a single row change.
+//
+//	{
+//	  "op": "update",
+//	  "schema": "public",
+//	  "table": "products",
+//	  "pk": {"id": 42},
+//	  "before": {"id": 42},
+//	  "after": {"id": 42, "name": "Lamp"},
+//	  "types": {"id": "integer", "name": "text"},
+//	  "lsn": "0/16B3748",
+//	  "xid": 731,
+//	  "commit_ts": "2026-10-19T08:49:14.806671Z"
+//	}
+//
+// Op is one of insert, update or delete. Before holds the old key columns
+// reported by Postgres (every column with REPLICA IDENTITY FULL) and is empty
+// for inserts; After is empty for deletes. LSN is the position of the
+// transaction the row belongs to.
+type ChangeEvent struct {
+	Op         string                 `json:"op"`
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	PK         map[string]interface{} `json:"pk,omitempty"`
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+	Types      map[string]string      `json:"types,omitempty"`
+	LSN        string                 `json:"lsn"`
+	XID        uint32                 `json:"xid,omitempty"`
+	CommitTime time.Time              `json:"commit_ts"`
+}
+
+// QualifiedTable returns the table as schema.table.
+func (e ChangeEvent) QualifiedTable() string {
+	return e.Schema + "." + e.Table
+}
+
+// Msg builds the NATS message carrying the encoded event. seq is the position
+// of the row inside its transaction and makes the message id unique, so
+// JetStream drops duplicates when a transaction is sent again after a restart.
+func (e ChangeEvent) Msg(subject string, data []byte, seq int) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(HeaderTable, e.QualifiedTable())
+	msg.Header.Set(HeaderOp, e.Op)
+	msg.Header.Set(HeaderLSN, e.LSN)
+	msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", e.LSN, seq))
+	return msg
+}
+
+// DecodeEvent decodes a change event published in either output format.
+// Numbers are kept as json.Number so keys and numeric values survive without
+// losing precision.
+func DecodeEvent(data []byte) (ChangeEvent, error) {
+	var probe struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return ChangeEvent{}, fmt.Errorf("failed to decode change event: %w", err)
+	}
+
+	if len(probe.Payload) > 0 {
+		var dbz DebeziumEvent
+		if err := decodeJSON(data, &dbz); err != nil {
+			return ChangeEvent{}, fmt.Errorf("failed to decode debezium event: %w", err)
+		}
+		return FromDebezium(dbz)
+	}
+
+	var event ChangeEvent
+	if err := decodeJSON(data, &event); err != nil {
+		return event, fmt.Errorf("failed to decode change event: %w", err)
+	}
+	return event, nil
+}
+
+// DecodeWAL2JSON splits a wal2json transaction into one ChangeEvent per row.
+// primaryKeys maps a table (schema.table or bare name) to its key columns;
+// tables without an entry fall back to the old keys sent by Postgres.
+func DecodeWAL2JSON(data []byte, lsn LSN, primaryKeys map[string][]string) ([]ChangeEvent, error) {
+	var walData WALData
+	if err := decodeJSON(data, &walData); err != nil {
+		return nil, fmt.Errorf("failed to decode wal2json data: %w", err)
+	}
+
+	commitTime, err := parseWAL2JSONTimestamp(walData.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]ChangeEvent, 0, len(walData.Change))
+	for _, change := range walData.Change {
+		event := ChangeEvent{
+			Op:         change.Kind,
+			Schema:     change.Schema,
+			Table:      change.Table,
+			LSN:        lsn.String(),
+			XID:        walData.Xid,
+			CommitTime: commitTime,
+		}
+
+		if len(change.ColumnNames) > 0 {
+			var values []interface{}
+			if err := decodeJSON(change.ColumnValues, &values); err != nil {
+				return nil, fmt.Errorf("failed to decode column values of %s: %w", event.QualifiedTable(), err)
+			}
+			event.After = make(map[string]interface{}, len(change.ColumnNames))
+			event.Types = make(map[string]string, len(change.ColumnNames))
+			for i, name := range change.ColumnNames {
+				if i < len(values) {
+					event.After[name] = values[i]
+				}
+				if i < len(change.ColumnTypes) {
+					event.Types[name] = change.ColumnTypes[i]
+				}
+			}
+		}
+
+		if change.OldKeys != nil {
+			var values []interface{}
+			if err := decodeJSON(change.OldKeys.KeyValues, &values); err != nil {
+				return nil, fmt.Errorf("failed to decode old keys of %s: %w", event.QualifiedTable(), err)
+			}
+			event.Before = make(map[string]interface{}, len(change.OldKeys.KeyNames))
+			if event.Types == nil {
+				event.Types = make(map[string]string, len(change.OldKeys.KeyNames))
+			}
+			for i, name := range change.OldKeys.KeyNames {
+				if i < len(values) {
+					event.Before[name] = values[i]
+				}
+				if _, ok := event.Types[name]; !ok && i < len(change.OldKeys.KeyTypes) {
+					event.Types[name] = change.OldKeys.KeyTypes[i]
+				}
+			}
+		}
+
+		keys, ok := primaryKeys[event.QualifiedTable()]
+		if !ok {
+			keys = primaryKeys[event.Table]
+		}
+		if len(keys) == 0 && change.OldKeys != nil {
+			keys = change.OldKeys.KeyNames
+		}
+		event.PK = primaryKeyValues(keys, event.After, event.Before)
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func primaryKeyValues(keys []string, after, before map[string]interface{}) map[string]interface{} {
+	if len(keys) == 0 {
+		return nil
+	}
+	pk := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := after[key]; ok {
+			pk[key] = value
+		} else if value, ok := before[key]; ok {
+			pk[key] = value
+		}
+	}
+	return pk
+}
+
+// parseWAL2JSONTimestamp parses the include-timestamp format, for example
+// "2026-10-19 08:49:14.806671+00".
+func parseWAL2JSONTimestamp(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07", "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse commit timestamp %q", ts)
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
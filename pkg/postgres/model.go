@@ -19,5 +19,8 @@ type WALOldKeys struct {
 }
 
 type WALData struct {
-    Change []WALChange `json:"change"`
+    Xid       uint32      `json:"xid,omitempty"`
+    Timestamp string      `json:"timestamp,omitempty"`
+    NextLSN   string      `json:"nextlsn,omitempty"`
+    Change    []WALChange `json:"change"`
 }
\ No newline at end of file
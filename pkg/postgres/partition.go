@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPartitionTTL is how long NewPartitionResolver keeps a resolved root.
+const DefaultPartitionTTL = time.Minute
+
+// PartitionResolver maps partitions to the root of their partition tree.
+// wal2json reports changes under the partition's own name, while sync
+// entries name the partitioned parent. Results are cached for TTL, after
+// which they are looked up again, so a partition that was detached or
+// attached elsewhere is routed by its new place within TTL; wal2json sends
+// no DDL to invalidate them earlier. Partitions created later are looked up
+// on first sight.
+type PartitionResolver struct {
+	DB  *sql.DB
+	TTL time.Duration
+
+	mu    sync.Mutex
+	roots map[string]cachedRoot
+}
+
+type cachedRoot struct {
+	root    TableName
+	expires time.Time
+}
+
+func NewPartitionResolver(db *sql.DB) *PartitionResolver {
+	return &PartitionResolver{DB: db, TTL: DefaultPartitionTTL, roots: make(map[string]cachedRoot)}
+}
+
+// Root returns the partition root of table, or table itself when it is not a
+// partition or no longer exists.
+func (r *PartitionResolver) Root(ctx context.Context, table TableName) (TableName, error) {
+	key := table.String()
+
+	r.mu.Lock()
+	cached, ok := r.roots[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.root, nil
+	}
+
+	root := table
+	err := r.DB.QueryRowContext(ctx, `SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = pg_partition_root(to_regclass($1))`, table.Sanitize()).Scan(&root.Schema, &root.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return table, fmt.Errorf("failed to resolve partition root of %s: %w", key, err)
+	}
+
+	r.mu.Lock()
+	if r.roots == nil {
+		r.roots = make(map[string]cachedRoot)
+	}
+	r.roots[key] = cachedRoot{root: root, expires: time.Now().Add(r.TTL)}
+	r.mu.Unlock()
+	return root, nil
+}
+
+// Resolve renames a change event of a partition to its root table and
+// recomputes the key, since primary keys are configured on the root.
+func (r *PartitionResolver) Resolve(ctx context.Context, event *ChangeEvent, primaryKeys map[string][]string) error {
+	root, err := r.Root(ctx, TableName{Schema: event.Schema, Name: event.Table})
+	if err != nil {
+		return err
+	}
+	if root.Schema == event.Schema && root.Name == event.Table {
+		return nil
+	}
+
+	event.Schema, event.Table = root.Schema, root.Name
+	keys, ok := primaryKeys[root.String()]
+	if !ok {
+		keys = primaryKeys[root.Name]
+	}
+	if len(keys) > 0 {
+		event.PK = primaryKeyValues(keys, event.After, event.Before)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ReconcilePublication makes publication cover exactly the given tables. It
+// creates the publication when missing, otherwise it adds and drops tables
+// until the publication matches. The returned tables, in configured form,
+// are the ones added to an existing publication; they have never been
+// indexed and need a backfill.
+//
+// wal2json ignores publications and streams every table, so the result does
+// not change what this sync receives. The publication is kept for pgoutput
+// consumers and tools that read it; on Postgres 13+ it is created with
+// publish_via_partition_root, so they see changes of partitions under the
+// partitioned root table, as this sync does.
+//
+// Row filters and column lists are never put into the publication: they
+// are applied by the sync, and on Postgres 15+ a row filter on a column
+// outside the replica identity makes Postgres reject every UPDATE and
+// DELETE on the table. Filters left on the publication are removed.
+func ReconcilePublication(ctx context.Context, db *sql.DB, publication string, tables []string, l *log.Logger) ([]string, error) {
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables provided for replication setup")
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return nil, fmt.Errorf("read server version: %w", err)
+	}
+	viaRoot := version >= 130000
+
+	wanted := make(map[string]string, len(tables))
+	for _, table := range tables {
+		qualified, err := resolveTable(ctx, db, table)
+		if err != nil {
+			return nil, err
+		}
+		wanted[qualified] = table
+	}
+
+	name := pgx.Identifier{publication}.Sanitize()
+
+	var allTables, pubViaRoot bool
+	rootColumn := "false"
+	if viaRoot {
+		rootColumn = "pubviaroot"
+	}
+	err := db.QueryRowContext(ctx, "SELECT puballtables, "+rootColumn+" FROM pg_publication WHERE pubname = $1", publication).Scan(&allTables, &pubViaRoot)
+	if errors.Is(err, sql.ErrNoRows) {
+		query := fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", name, tableList(sortedKeys(wanted)))
+		if viaRoot {
+			query += " WITH (publish_via_partition_root = true)"
+		}
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("create publication %s: %w", publication, err)
+		}
+		l.Printf("created publication %s", publication)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup publication %s: %w", publication, err)
+	}
+	if allTables {
+		l.Printf("publication %s is FOR ALL TABLES; leaving it unchanged", publication)
+		return nil, nil
+	}
+
+	// Changes of partitions are published under the partitioned parent, for
+	// pgoutput consumers of the publication.
+	if viaRoot && !pubViaRoot {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER PUBLICATION %s SET (publish_via_partition_root = true)", name)); err != nil {
+			return nil, fmt.Errorf("update publication %s: %w", publication, err)
+		}
+		l.Printf("enabled publish_via_partition_root on publication %s", publication)
+	}
+
+	current, err := publicationTables(ctx, db, publication)
+	if err != nil {
+		return nil, err
+	}
+
+	var toAdd, toDrop []string
+	for qualified := range wanted {
+		if !current[qualified] {
+			toAdd = append(toAdd, qualified)
+		}
+	}
+	for qualified := range current {
+		if _, ok := wanted[qualified]; !ok {
+			toDrop = append(toDrop, qualified)
+		}
+	}
+	sort.Strings(toAdd)
+	sort.Strings(toDrop)
+
+	filtered, err := PublicationFiltered(ctx, db, publication, "")
+	if err != nil {
+		return nil, err
+	}
+	if filtered {
+		// SET TABLE replaces the whole definition, row filters and column
+		// lists included.
+		query := fmt.Sprintf("ALTER PUBLICATION %s SET TABLE %s", name, tableList(sortedKeys(wanted)))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("update publication %s: %w", publication, err)
+		}
+		l.Printf("removed row filters and column lists from publication %s", publication)
+	} else {
+		if len(toDrop) > 0 {
+			query := fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s", name, tableList(toDrop))
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				return nil, fmt.Errorf("drop tables from publication %s: %w", publication, err)
+			}
+		}
+		if len(toAdd) > 0 {
+			query := fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s", name, tableList(toAdd))
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				return nil, fmt.Errorf("add tables to publication %s: %w", publication, err)
+			}
+		}
+	}
+
+	if len(toDrop) > 0 {
+		l.Printf("dropped %s from publication %s", strings.Join(toDrop, ", "), publication)
+	}
+	var added []string
+	if len(toAdd) > 0 {
+		l.Printf("added %s to publication %s", strings.Join(toAdd, ", "), publication)
+		for _, qualified := range toAdd {
+			added = append(added, wanted[qualified])
+		}
+	}
+
+	if len(toAdd) == 0 && len(toDrop) == 0 && !filtered {
+		l.Printf("publication %s is up to date", publication)
+	}
+	return added, nil
+}
+
+// PublicationFiltered reports whether publication has a row filter or column
+// list (Postgres 15+) on table, or on any of its tables when table is empty.
+func PublicationFiltered(ctx context.Context, db *sql.DB, publication, table string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1
+		FROM pg_publication_rel r
+		JOIN pg_publication p ON p.oid = r.prpubid
+		WHERE p.pubname = $1 AND ($2::text = '' OR r.prrelid = to_regclass($2::text))
+			AND (to_jsonb(r) ->> 'prqual' IS NOT NULL OR to_jsonb(r) ->> 'prattrs' IS NOT NULL))`
+	if table != "" {
+		table = ParseTableName(table).Sanitize()
+	}
+	var filtered bool
+	if err := db.QueryRowContext(ctx, query, publication, table).Scan(&filtered); err != nil {
+		return false, fmt.Errorf("look up filters of publication %s: %w", publication, err)
+	}
+	return filtered, nil
+}
+
+// resolveTable checks that a configured table exists and returns it as
+// schema.table.
+func resolveTable(ctx context.Context, db *sql.DB, table string) (string, error) {
+	var schema, name string
+	err := db.QueryRowContext(ctx, `SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = to_regclass($1)`, ParseTableName(table).Sanitize()).Scan(&schema, &name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("table %s does not exist", table)
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve table %s: %w", table, err)
+	}
+	return schema + "." + name, nil
+}
+
+func publicationTables(ctx context.Context, db *sql.DB, publication string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT schemaname, tablename FROM pg_publication_tables WHERE pubname = $1", publication)
+	if err != nil {
+		return nil, fmt.Errorf("list tables of publication %s: %w", publication, err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, err
+		}
+		tables[schema+"."+name] = true
+	}
+	return tables, rows.Err()
+}
+
+// tableList quotes schema.table names for use in publication commands.
+func tableList(tables []string) string {
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = ParseTableName(table).Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
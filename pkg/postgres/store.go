@@ -2,12 +2,17 @@ package postgres
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"nats-jetstream/pkg/checkpoint"
+
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
@@ -51,6 +56,54 @@ func init() {
 }
 
 
+// ReplicationConfig describes what StartReplicationDatabase replicates and
+// where the change events go.
+type ReplicationConfig struct {
+	// SlotName, Publication and ApplicationName identify this instance's
+	// objects in Postgres. Empty values fall back to the defaults.
+	SlotName        string
+	Publication     string
+	ApplicationName string
+	// Subject is the JetStream subject change events are published on.
+	Subject string
+	// Tables are the tables added to the publication.
+	Tables []string
+	// PrimaryKeys maps a table to its key columns, used for the pk field of
+	// the change events.
+	PrimaryKeys map[string][]string
+	// Format is the output format of published events, FormatEnvelope or
+	// FormatDebezium. The callback always receives envelopes.
+	Format string
+	// Checkpoints, when set, stores the last confirmed WAL position so a
+	// restart resumes from it instead of recreating the slot.
+	Checkpoints checkpoint.Store
+	// Partitions, when set, reports changes of partitions under their
+	// partitioned root table.
+	Partitions *PartitionResolver
+	// Watermark, when set, holds the confirmed position below the changes
+	// the callback handed off but not yet applied.
+	Watermark *Watermark
+}
+
+// Defaults used when the replication names are not configured.
+const (
+	DefaultSlotName        = "replication_demo"
+	DefaultPublicationName = "replication_demo"
+	DefaultApplicationName = "replication"
+)
+
+func (cfg *ReplicationConfig) withDefaults() {
+	if cfg.SlotName == "" {
+		cfg.SlotName = DefaultSlotName
+	}
+	if cfg.Publication == "" {
+		cfg.Publication = DefaultPublicationName
+	}
+	if cfg.ApplicationName == "" {
+		cfg.ApplicationName = DefaultApplicationName
+	}
+}
+
 type Store struct {
 	Pool   *pgxpool.Pool
 	Logger *log.Logger
@@ -95,11 +148,15 @@ func New(ctx context.Context, logger *log.Logger) *Store {
 	return &store
 }
 
-func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, jetstreamSubject string, callback func([]byte),  tableName []string, l *log.Logger) {
-	applicationName := "replication"
+// StartReplicationDatabase streams the WAL through wal2json and turns every
+// row change into an encoded ChangeEvent, which is handed to callback (when
+// set) and published to JetStream (when js is set). It returns once ctx is
+// done.
+func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, callback func([]byte), cfg ReplicationConfig, l *log.Logger) {
+	cfg.withDefaults()
 	dsn := fmt.Sprintf(
 		"postgres://%s:%s@%s:%s/%s?replication=database&application_name=%s&sslmode=disable",
-		User, Password, Host, Port, Database, applicationName,
+		User, Password, Host, Port, Database, url.QueryEscape(cfg.ApplicationName),
 	)
 	conn, err := pgconn.Connect(ctx, dsn)
 	if err != nil {
@@ -107,7 +164,26 @@ func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, jet
 	}
 	defer conn.Close(ctx)
 
-	setupReplication(ctx, conn, tableName, l)
+	slotName := cfg.SlotName
+	checkpointKey := checkpoint.ReplicationKey(slotName)
+
+	var resumeLSN LSN
+	if cfg.Checkpoints != nil {
+		value, ok, err := cfg.Checkpoints.Load(ctx, checkpointKey)
+		if err != nil {
+			l.Fatal("Failed to load replication checkpoint", zap.Error(err))
+		}
+		if ok {
+			if resumeLSN, err = ParseLSN(value); err != nil {
+				l.Fatal("Invalid replication checkpoint", zap.Error(err))
+			}
+		}
+	}
+
+	slotLSN, err := setupReplication(ctx, conn, cfg, resumeLSN, l)
+	if err != nil {
+		l.Fatal("Replication setup failed: ", err)
+	}
 
 	sysident, err := IdentifySystem(ctx, conn)
 	if err != nil {
@@ -115,32 +191,74 @@ func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, jet
 	}
 	l.Println("SystemID", zap.String("SystemID", sysident.SystemID), zap.Uint32("Timeline", uint32(sysident.Timeline)), zap.String("XLogPos", sysident.XLogPos.String()), zap.String("DBName", sysident.DBName))
 
-	slotName := "replication_demo"
-	pluginArguments := []string{"\"pretty-print\" 'true'"}
+	startLSN := sysident.XLogPos
+	if slotLSN > 0 {
+		startLSN = slotLSN
+		l.Printf("Resuming replication on slot %s from %s", slotName, startLSN)
+	}
 
-	err = StartReplication(ctx, conn, slotName, sysident.XLogPos, StartReplicationOptions{PluginArgs: pluginArguments})
+	pluginArguments := []string{
+		"\"pretty-print\" 'true'",
+		"\"include-xids\" 'true'",
+		"\"include-timestamp\" 'true'",
+		// Checkpoints written to the source database must not come back as
+		// changes, or every saved position would produce another change.
+		fmt.Sprintf("\"filter-tables\" '*.%s'", checkpoint.PostgresTable),
+	}
+
+	err = StartReplication(ctx, conn, slotName, startLSN, StartReplicationOptions{PluginArgs: pluginArguments})
 	if err != nil {
 		l.Fatal("StartReplication failed", zap.Error(err))
 	}
 	l.Println("Logical replication started on slot", zap.String("slotName", slotName))
 
-	clientXLogPos := sysident.XLogPos
+	clientXLogPos := startLSN
+	confirmedLSN := startLSN
+	// changeLSN is the position of the last change handed off, savedLSN the
+	// last position saved to the checkpoint store.
+	var changeLSN LSN
+	savedLSN := startLSN
 	standbyMessageTimeout := time.Second * 10
 	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
 	for {
 		if time.Now().After(nextStandbyMessageDeadline) {
-			err := SendStandbyStatusUpdate(ctx, conn, StandbyStatusUpdate{WALWritePosition: clientXLogPos})
+			flushLSN := clientXLogPos
+			if cfg.Watermark != nil {
+				flushLSN = cfg.Watermark.Confirmable(clientXLogPos)
+			}
+			if flushLSN > confirmedLSN && publishesComplete(js, standbyMessageTimeout, l) {
+				// A position is only saved when changes arrived since the last
+				// save. Keepalives advance it without any, for instance past
+				// the checkpoint write itself, and saving those would write
+				// again every round while the source is idle.
+				if cfg.Checkpoints != nil && savedLSN < changeLSN {
+					if err := cfg.Checkpoints.Save(ctx, checkpointKey, flushLSN.String()); err != nil {
+						l.Printf("Failed to save replication checkpoint: %v", err)
+					} else {
+						confirmedLSN = flushLSN
+						savedLSN = flushLSN
+					}
+				} else {
+					confirmedLSN = flushLSN
+				}
+			}
+
+			err := SendStandbyStatusUpdate(ctx, conn, StandbyStatusUpdate{WALWritePosition: clientXLogPos, WALFlushPosition: confirmedLSN})
 			if err != nil {
 				l.Fatal("SendStandbyStatusUpdate failed", zap.Error(err))
 			}
-			l.Println("Sent Standby status message", zap.String("WALWritePosition", clientXLogPos.String()))
+			l.Println("Sent Standby status message", zap.String("WALWritePosition", clientXLogPos.String()), zap.String("WALFlushPosition", confirmedLSN.String()))
 			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
 		}
 
-		ctx, cancel := context.WithDeadline(ctx, nextStandbyMessageDeadline)
-		rawMsg, err := conn.ReceiveMessage(ctx)
+		recvCtx, cancel := context.WithDeadline(ctx, nextStandbyMessageDeadline)
+		rawMsg, err := conn.ReceiveMessage(recvCtx)
 		cancel()
 		if err != nil {
+			if ctx.Err() != nil {
+				l.Println("Logical replication stopped on slot", zap.String("slotName", slotName))
+				return
+			}
 			if pgconn.Timeout(err) {
 				continue
 			}
@@ -181,21 +299,60 @@ func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, jet
 
 			// l.Println("wal2json data", zap.String("data", string(xld.WALData)))
 
-			callback(xld.WALData)
+			events, err := DecodeWAL2JSON(xld.WALData, xld.WALStart, cfg.PrimaryKeys)
+			if err != nil {
+				l.Fatal("Failed to decode WAL data", zap.Error(err))
+			}
 
-			// l.Println("WAL data sent to channel", zap.String("data", string(xld.WALData)))
+			for i, event := range events {
+				if cfg.Partitions != nil {
+					if err := cfg.Partitions.Resolve(ctx, &event, cfg.PrimaryKeys); err != nil {
+						l.Fatal("Failed to resolve partition", zap.Error(err))
+					}
+				}
 
-			if js != nil {
-				_, errPub := js.PublishAsync(jetstreamSubject, xld.WALData)
-				if errPub != nil {
-					l.Fatal("Failed to publish WAL data to NATS", zap.Error(errPub))
-				} else {
-					l.Print("Successfully initiated async publish of WAL data to NATS", zap.String("data", string(xld.WALData)))
+				data, err := json.Marshal(event)
+				if err != nil {
+					l.Fatal("Failed to encode change event", zap.Error(err))
+				}
+
+				if callback != nil {
+					callback(data)
 				}
+
+				if js != nil {
+					published := data
+					if cfg.Format == FormatDebezium {
+						if published, err = EncodeEvent(event, cfg.Format); err != nil {
+							l.Fatal("Failed to encode change event", zap.Error(err))
+						}
+					}
+
+					msg := event.Msg(cfg.Subject, published, i)
+					key, err := EncodeKey(event, cfg.Format)
+					if err != nil {
+						l.Fatal("Failed to encode change event key", zap.Error(err))
+					}
+					if key != nil {
+						msg.Header.Set(HeaderKey, string(key))
+					}
+
+					_, errPub := js.PublishMsgAsync(msg)
+					if errPub != nil {
+						l.Fatal("Failed to publish change event to NATS", zap.Error(errPub))
+					}
+				}
+			}
+
+			if js != nil {
+				l.Print("Successfully initiated async publish of change events to NATS", zap.Int("events", len(events)))
 			} else {
 				l.Print("JetStream is disabled; skipping publish")
 			}
 
+			if len(events) > 0 {
+				changeLSN = xld.WALStart
+			}
 			if xld.WALStart > clientXLogPos {
 				clientXLogPos = xld.WALStart
 			}
@@ -203,40 +360,150 @@ func StartReplicationDatabase(ctx context.Context, js nats.JetStreamContext, jet
 	}
 }
 
-func setupReplication(ctx context.Context, conn *pgconn.PgConn, tableName []string, l *log.Logger) {
-	if len(tableName) == 0 {
-		l.Println("No tables provided for replication setup")
-		return
+// publishesComplete waits until JetStream acknowledged every async publish, so
+// the WAL position is only confirmed once the events are stored.
+func publishesComplete(js nats.JetStreamContext, timeout time.Duration, l *log.Logger) bool {
+	if js == nil {
+		return true
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+		return true
+	case <-time.After(timeout):
+		l.Printf("Timed out waiting for %d pending publishes; not advancing the checkpoint", js.PublishAsyncPending())
+		return false
+	}
+}
+
+// setupReplication creates the replication slot if it is missing. An existing
+// slot is never dropped: it is reused after checking that it belongs to this
+// configuration, whose ownership ClaimSlot recorded at startup. The returned LSN is where streaming resumes, or 0 when the
+// slot was just created. The publication is set up beforehand by
+// ReconcilePublication.
+func setupReplication(ctx context.Context, conn *pgconn.PgConn, cfg ReplicationConfig, resumeLSN LSN, l *log.Logger) (LSN, error) {
+	slot, err := lookupSlot(ctx, conn, cfg.SlotName)
+	if err != nil {
+		return 0, err
+	}
+
+	if slot == nil {
+		query := fmt.Sprintf("SELECT * FROM pg_create_logical_replication_slot(%s, 'wal2json');", quoteLiteral(cfg.SlotName))
+		if _, err := conn.Exec(ctx, query).ReadAll(); err != nil {
+			return 0, fmt.Errorf("create replication slot %s: %w", cfg.SlotName, err)
+		}
+		l.Printf("created new replication slot %s", cfg.SlotName)
+		if resumeLSN > 0 {
+			l.Printf("replication slot %s was gone; changes since checkpoint %s must be backfilled", cfg.SlotName, resumeLSN)
+		}
+		return 0, nil
+	}
+
+	if err := slot.check(cfg); err != nil {
+		return 0, err
 	}
 
-	// Join table names into a comma-separated string
-	tables := strings.Join(tableName, ", ")
+	startLSN := slot.ConfirmedFlush
+	if resumeLSN > startLSN {
+		startLSN = resumeLSN
+	}
+	l.Printf("reusing replication slot %s from %s", cfg.SlotName, startLSN)
+	return startLSN, nil
+}
 
-	query := fmt.Sprintf("CREATE PUBLICATION replication_demo FOR TABLE %s;", tables)
-	result := conn.Exec(ctx, query)
+// replicationSlot is the part of pg_replication_slots used to decide whether
+// a slot may be reused.
+type replicationSlot struct {
+	Name            string
+	Plugin          string
+	Database        string
+	Active          bool
+	ApplicationName string
+	ConfirmedFlush  LSN
+}
 
-	_, err := result.ReadAll()
+func lookupSlot(ctx context.Context, conn *pgconn.PgConn, name string) (*replicationSlot, error) {
+	query := fmt.Sprintf(`SELECT s.plugin, s.database, s.active, COALESCE(r.application_name, ''), COALESCE(s.confirmed_flush_lsn::text, '')
+		FROM pg_replication_slots s
+		LEFT JOIN pg_stat_replication r ON r.pid = s.active_pid
+		WHERE s.slot_name = %s;`, quoteLiteral(name))
+	results, err := conn.Exec(ctx, query).ReadAll()
 	if err != nil {
-		if strings.Contains(err.Error(), "publication \"replication_demo\" already exists") {
-			l.Println("publication replication_demo already exists")
-		} else {
-			l.Fatal("create publication error", zap.Error(err))
+		return nil, fmt.Errorf("lookup replication slot %s: %w", name, err)
+	}
+	if len(results) != 1 || len(results[0].Rows) == 0 {
+		return nil, nil
+	}
+
+	row := results[0].Rows[0]
+	slot := &replicationSlot{
+		Name:            name,
+		Plugin:          string(row[0]),
+		Database:        string(row[1]),
+		Active:          string(row[2]) == "t",
+		ApplicationName: string(row[3]),
+	}
+	if len(row[4]) > 0 {
+		if slot.ConfirmedFlush, err = ParseLSN(string(row[4])); err != nil {
+			return nil, err
 		}
-	} else {
-		l.Println("create publication replication_demo")
 	}
-	result = conn.Exec(ctx, "SELECT pg_drop_replication_slot('replication_demo');")
-	_, err = result.ReadAll()
-	if err != nil && !strings.Contains(err.Error(), "does not exist") {
-		l.Fatal("drop replication slot error", zap.Error(err))
-	} else if err == nil {
-		l.Println("dropped existing replication slot replication_demo")
+	return slot, nil
+}
+
+// check refuses slots created for another plugin or database, and slots
+// currently streamed by a different application.
+func (s *replicationSlot) check(cfg ReplicationConfig) error {
+	if s.Plugin != "wal2json" {
+		return fmt.Errorf("replication slot %s uses plugin %q, not wal2json; choose another slot name", s.Name, s.Plugin)
+	}
+	if s.Database != Database {
+		return fmt.Errorf("replication slot %s belongs to database %q, not %q; choose another slot name", s.Name, s.Database, Database)
 	}
+	if s.Active {
+		if s.ApplicationName != cfg.ApplicationName {
+			return fmt.Errorf("replication slot %s is in use by application %q; choose another slot name", s.Name, s.ApplicationName)
+		}
+		return fmt.Errorf("replication slot %s is already streaming to another %q instance", s.Name, s.ApplicationName)
+	}
+	return nil
+}
+
+// slotOwner describes the configuration recorded as the owner of a slot.
+func slotOwner(cfg ReplicationConfig) string {
+	return fmt.Sprintf("publication=%s application_name=%s", cfg.Publication, cfg.ApplicationName)
+}
 
-	result = conn.Exec(ctx, "SELECT * FROM pg_create_logical_replication_slot('replication_demo', 'wal2json');")
-	_, err = result.ReadAll()
+// ClaimSlot records this configuration as the owner of the replication slot
+// in the syncmeili_checkpoints table of the source database, whatever store
+// keeps the other checkpoints, so every deployment sharing the database sees
+// it. It fails if the slot exists and belongs to a different configuration;
+// the recorded owner of a slot that was dropped is replaced.
+func ClaimSlot(ctx context.Context, db *sql.DB, cfg ReplicationConfig) error {
+	cfg.withDefaults()
+	store, err := checkpoint.NewPostgresStore(ctx, db)
 	if err != nil {
-		l.Fatal("create replication slot error", zap.Error(err))
+		return err
 	}
-	l.Println("created new replication slot replication_demo")
+	key := checkpoint.SlotOwnerKey(cfg.SlotName)
+	owner, ok, err := store.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("load owner of replication slot %s: %w", cfg.SlotName, err)
+	}
+	if ok && owner == slotOwner(cfg) {
+		return nil
+	}
+	if ok {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", cfg.SlotName).Scan(&exists); err != nil {
+			return fmt.Errorf("lookup replication slot %s: %w", cfg.SlotName, err)
+		}
+		if exists {
+			return fmt.Errorf("replication slot %s belongs to a different configuration (%s); choose another slot name", cfg.SlotName, owner)
+		}
+	}
+	return store.Save(ctx, key, slotOwner(cfg))
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
 }
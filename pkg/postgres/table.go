@@ -0,0 +1,36 @@
+package postgres
+
+import (
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultSchema is assumed for table names configured without a schema.
+const DefaultSchema = "public"
+
+// TableName is a schema-qualified table name.
+type TableName struct {
+	Schema string
+	Name   string
+}
+
+// ParseTableName splits "schema.table"; a bare name is placed in
+// DefaultSchema.
+func ParseTableName(table string) TableName {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return TableName{Schema: schema, Name: name}
+	}
+	return TableName{Schema: DefaultSchema, Name: table}
+}
+
+// String returns the name as schema.table, the form used for routing and in
+// change events.
+func (t TableName) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// Sanitize returns the name quoted for use in SQL.
+func (t TableName) Sanitize() string {
+	return pgx.Identifier{t.Schema, t.Name}.Sanitize()
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import "sync"
+
+// Watermark tracks the transactions whose changes were handed off to be
+// applied asynchronously, so the replication loop confirms, and checkpoints,
+// only WAL positions below the oldest transaction not yet applied.
+type Watermark struct {
+	mu      sync.Mutex
+	pending map[LSN]int
+}
+
+// Add records a change of the transaction at lsn as pending.
+func (w *Watermark) Add(lsn LSN) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[LSN]int)
+	}
+	w.pending[lsn]++
+}
+
+// Done records a change of the transaction at lsn as applied.
+func (w *Watermark) Done(lsn LSN) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending[lsn] <= 1 {
+		delete(w.pending, lsn)
+		return
+	}
+	w.pending[lsn]--
+}
+
+// Confirmable returns the highest position up to received that can be
+// confirmed: received itself when nothing is pending, otherwise the
+// position just before the oldest pending transaction.
+func (w *Watermark) Confirmable(received LSN) LSN {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	confirmable := received
+	for lsn := range w.pending {
+		if lsn > 0 && lsn-1 < confirmable {
+			confirmable = lsn - 1
+		}
+	}
+	return confirmable
+}
+
+// Pending returns the number of changes not yet applied.
+func (w *Watermark) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	total := 0
+	for _, n := range w.pending {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessChangesBatchesRuns(t *testing.T) {
+	server := recordRequests(t)
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "products",
+		Index:     "products",
+		PK:        "id",
+	}
+
+	row := func(id string, name string) map[string]interface{} {
+		return map[string]interface{}{"id": json.Number(id), "name": name}
+	}
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: row("1", "Lamp")},
+		{Op: "update", PK: map[string]interface{}{"id": json.Number("2")}, After: row("2", "Desk")},
+		{Op: "delete", PK: map[string]interface{}{"id": json.Number("3")}},
+		{Op: "delete", PK: map[string]interface{}{"id": json.Number("1")}},
+		{Op: "insert", After: row("3", "Chair")},
+	})
+	assert.NoError(t, err)
+	// Runs of upserts and of deletes each become one request, in order, so
+	// the delete of 1 still follows its insert.
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents [{"id":1,"name":"Lamp"},{"id":2,"name":"Desk"}]`,
+		`POST /indexes/products/documents/delete-batch ["3","1"]`,
+		`POST /indexes/products/documents [{"id":3,"name":"Chair"}]`,
+	}, server.Requests())
+
+	// A failed request fails the whole call, so the caller can retry it.
+	server.Reset()
+	server.Respond(500)
+	assert.Error(t, handler.ProcessChanges([]postgres.ChangeEvent{{Op: "insert", After: row("4", "Shelf")}}))
+}
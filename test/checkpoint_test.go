@@ -0,0 +1,176 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"nats-jetstream/pkg/checkpoint"
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/nat"
+	"nats-jetstream/pkg/postgres"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertStoreRoundTrip(t *testing.T, store checkpoint.Store) {
+	ctx := context.Background()
+
+	_, ok, err := store.Load(ctx, checkpoint.ReplicationKey("replication_demo"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, store.Save(ctx, checkpoint.ReplicationKey("replication_demo"), "0/16B3748"))
+	assert.NoError(t, store.Save(ctx, checkpoint.BackfillKey("public.products"), checkpoint.BackfillDone))
+
+	value, ok, err := store.Load(ctx, checkpoint.ReplicationKey("replication_demo"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "0/16B3748", value)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "checkpoints.json")
+
+	store, err := checkpoint.NewFileStore(path)
+	assert.NoError(t, err)
+	assertStoreRoundTrip(t, store)
+
+	reopened, err := checkpoint.NewFileStore(path)
+	assert.NoError(t, err)
+
+	value, ok, err := reopened.Load(context.Background(), checkpoint.BackfillKey("public.products"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, checkpoint.BackfillDone, value)
+}
+
+func TestKVCheckpointStore(t *testing.T) {
+	logger := log.New(os.Stdout, "test: ", log.LstdFlags)
+
+	ns, err := nat.StartEmbeddedServer(nat.EmbeddedServerOptions{StoreDir: t.TempDir(), Port: -1}, logger)
+	assert.NoError(t, err)
+	defer ns.Shutdown()
+
+	nc, js, err := (&nat.EmbeddedConnector{Server: ns}).Connect(false)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	store, err := checkpoint.NewKVStore(js.(*nat.JetStreamContextImpl).JS, "syncmeili_checkpoints")
+	assert.NoError(t, err)
+	assertStoreRoundTrip(t, store)
+}
+
+func TestTaskCheckpointKeepsNewestUID(t *testing.T) {
+	// Parallel workers can get their responses out of order; the server
+	// answers with these task uids in turn.
+	uids := []int{7, 4, 9}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"taskUid":%d}`, uids[0])
+		uids = uids[1:]
+	}))
+	defer server.Close()
+
+	fileStore, err := checkpoint.NewFileStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	assert.NoError(t, err)
+	store := &countingStore{Store: fileStore}
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:     server.URL,
+		TableName:   "products",
+		Index:       "products",
+		PK:          "id",
+		Checkpoints: store,
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{
+			Op:    "insert",
+			Table: "products",
+			After: map[string]interface{}{"id": json.Number(id)},
+		}))
+	}
+
+	// The older uid 4 never replaces 7, and 9 waits for the end of the save
+	// interval rather than costing a write per request.
+	assert.Equal(t, []string{"7"}, store.Saves())
+	assert.Eventually(t, func() bool {
+		return len(store.Saves()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []string{"7", "9"}, store.Saves())
+
+	value, _, err := store.Load(context.Background(), checkpoint.TaskKey("products"))
+	assert.NoError(t, err)
+	assert.Equal(t, "9", value)
+}
+
+// countingStore counts the saves of the store it wraps.
+type countingStore struct {
+	checkpoint.Store
+
+	mu    sync.Mutex
+	saves []string
+}
+
+func (s *countingStore) Save(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	s.saves = append(s.saves, value)
+	s.mu.Unlock()
+	return s.Store.Save(ctx, key, value)
+}
+
+func (s *countingStore) Saves() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.saves...)
+}
+
+func TestReplicationCheckpointsOnlyChanges(t *testing.T) {
+	server := serveReplication(t)
+	fileStore, err := checkpoint.NewFileStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	assert.NoError(t, err)
+	store := &countingStore{Store: fileStore}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		postgres.StartReplicationDatabase(ctx, nil, nil, postgres.ReplicationConfig{Checkpoints: store}, log.New(io.Discard, "", 0))
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	server.SendWAL(0x2000, `{"xid":1,"change":[{"kind":"insert","schema":"public","table":"products","columnnames":["id"],"columntypes":["integer"],"columnvalues":[1]}]}`)
+	server.SendKeepalive(0x2100)
+	assert.Equal(t, postgres.LSN(0x2100), server.NextUpdate(t).WALFlushPosition)
+	assert.Equal(t, []string{"0/2100"}, store.Saves())
+
+	// Saving the checkpoint moved the WAL on; the new position is confirmed
+	// but not saved again, as no change came with it.
+	server.SendKeepalive(0x2200)
+	assert.Equal(t, postgres.LSN(0x2200), server.NextUpdate(t).WALFlushPosition)
+	assert.Equal(t, []string{"0/2100"}, store.Saves())
+
+	// wal2json leaves out the checkpoint table itself.
+	var start string
+	for _, query := range server.Queries() {
+		if strings.HasPrefix(query, "START_REPLICATION") {
+			start = query
+		}
+	}
+	assert.Contains(t, start, `"filter-tables" '*.syncmeili_checkpoints'`)
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceWindow(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:        server.URL,
+		TableName:      "jobs",
+		Index:          "jobs",
+		PK:             "id",
+		CoalesceWindow: 50 * time.Millisecond,
+	}
+	row := func(op string, id int, fields map[string]interface{}) postgres.ChangeEvent {
+		change := postgres.ChangeEvent{Op: op, PK: map[string]interface{}{"id": id}}
+		if op != "delete" {
+			change.After = map[string]interface{}{"id": id}
+			for k, v := range fields {
+				change.After[k] = v
+			}
+		}
+		return change
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	done := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		wg.Done()
+	}
+	wg.Add(2)
+	handler.Coalesce([]postgres.ChangeEvent{
+		row("insert", 1, map[string]interface{}{"status": "queued", "payload": "big"}),
+		row("update", 2, map[string]interface{}{"status": "running"}),
+		row("insert", 3, map[string]interface{}{"status": "queued"}),
+		row("update", 1, map[string]interface{}{"status": "running"}), // payload unchanged, left out
+	}, done)
+	handler.Coalesce([]postgres.ChangeEvent{
+		row("delete", 3, nil),
+		row("delete", 4, nil),
+		row("insert", 4, map[string]interface{}{"status": "queued"}),
+		row("delete", 4, nil),
+		row("update", 2, map[string]interface{}{"status": "done"}),
+	}, done)
+
+	assert.Empty(t, server.Requests(), "changes are held for the window")
+
+	wg.Wait()
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, []string{
+		`POST /indexes/jobs/documents [{"id":1,"payload":"big","status":"running"}]`,
+		`POST /indexes/jobs/documents/delete-batch ["4"]`,
+		`POST /indexes/jobs/documents [{"id":2,"status":"done"}]`,
+	}, server.Requests())
+}
+
+func TestCoalesceWithoutWindowWritesImmediately(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{BaseURL: server.URL, TableName: "jobs", Index: "jobs", PK: "id"}
+	var got error = assert.AnError
+	handler.Coalesce([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 1}},
+		{Op: "update", After: map[string]interface{}{"id": 1}},
+	}, func(err error) { got = err })
+	assert.NoError(t, got)
+	assert.Len(t, server.Requests(), 1)
+}
+
+func TestCoalesceUntilAppliedHoldsBackWhileRetrying(t *testing.T) {
+	server := recordRequests(t)
+	server.Respond(http.StatusInternalServerError)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:        server.URL,
+		TableName:      "jobs",
+		Index:          "jobs",
+		PK:             "id",
+		CoalesceWindow: 20 * time.Millisecond,
+	}
+	logger := log.New(io.Discard, "", 0)
+	var applied sync.WaitGroup
+	submit := func(id int) {
+		applied.Add(1)
+		handler.CoalesceUntilApplied([]postgres.ChangeEvent{
+			{Op: "insert", After: map[string]interface{}{"id": id}},
+		}, func(err error) {
+			assert.NoError(t, err)
+			applied.Done()
+		}, 1, logger)
+	}
+
+	// The first window's write fails and is retried; the next window fills
+	// up to the limit behind it.
+	submit(1)
+	time.Sleep(100 * time.Millisecond)
+	submit(2)
+
+	returned := make(chan struct{})
+	go func() {
+		submit(3)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		t.Fatal("changes were held beyond the limit while the write was retried")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	server.Respond(http.StatusAccepted)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("held back changes were never taken")
+	}
+	applied.Wait()
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/nat"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func startAuthServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Username:  "sync",
+		Password:  "secret",
+		NoSigs:    true,
+	})
+	assert.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestURLConnectorUserPassword(t *testing.T) {
+	ns := startAuthServer(t)
+
+	nc, js, err := (&nat.URLConnector{URL: ns.ClientURL(), User: "sync", Password: "secret"}).Connect(false)
+	assert.NoError(t, err)
+	assert.NotNil(t, js)
+	nc.Close()
+
+}
+
+// lockedBuffer collects log output written from the NATS callbacks.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestURLConnectorReportsAuthFailure(t *testing.T) {
+	ns := startAuthServer(t)
+	logs := &lockedBuffer{}
+
+	// The connection keeps retrying in the background, so a rejected
+	// password surfaces through the error and closed handlers.
+	nc, _, err := (&nat.URLConnector{
+		URL:           ns.ClientURL(),
+		User:          "sync",
+		Password:      "wrong",
+		MaxReconnects: 1,
+		ReconnectWait: 10 * time.Millisecond,
+		Logger:        log.New(logs, "", 0),
+	}).Connect(false)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(strings.ToLower(logs.String()), "authorization violation")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return nc.GetConn().IsClosed() }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, nc.GetConn().IsConnected())
+}
+
+func TestURLConnectorRejectsMissingNKey(t *testing.T) {
+	_, _, err := (&nat.URLConnector{URL: "nats://127.0.0.1:1", NKeyFile: "/does/not/exist.nk"}).Connect(false)
+	assert.Error(t, err)
+}
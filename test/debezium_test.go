@@ -0,0 +1,123 @@
+package test
+
+import (
+	"encoding/json"
+	"nats-jetstream/pkg/postgres"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebeziumFormatRoundTrip(t *testing.T) {
+	event := postgres.ChangeEvent{
+		Op:     "update",
+		Schema: "public",
+		Table:  "orders",
+		PK:     map[string]interface{}{"id": json.Number("7")},
+		Before: map[string]interface{}{"id": json.Number("7")},
+		After: map[string]interface{}{
+			"id":         json.Number("7"),
+			"placed_on":  "2026-10-19",
+			"updated_at": "2026-10-19 08:49:14.806671",
+		},
+		Types: map[string]string{
+			"id":         "integer",
+			"placed_on":  "date",
+			"updated_at": "timestamp without time zone",
+		},
+		LSN: "0/16B3748",
+		XID: 731,
+	}
+
+	data, err := postgres.EncodeEvent(event, postgres.FormatDebezium)
+	assert.NoError(t, err)
+
+	var dbz postgres.DebeziumEvent
+	assert.NoError(t, json.Unmarshal(data, &dbz))
+	assert.Equal(t, "u", dbz.Payload.Op)
+	assert.Equal(t, "postgresql", dbz.Payload.Source.Connector)
+	assert.Equal(t, "orders", dbz.Payload.Source.Table)
+	assert.Equal(t, uint64(0x16B3748), dbz.Payload.Source.LSN)
+	assert.Equal(t, float64(20745), dbz.Payload.After["placed_on"])
+
+	decoded, err := postgres.DecodeEvent(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "update", decoded.Op)
+	assert.Equal(t, "public.orders", decoded.QualifiedTable())
+	assert.Equal(t, "0/16B3748", decoded.LSN)
+	assert.Equal(t, event.After["placed_on"], decoded.After["placed_on"])
+	assert.Equal(t, event.After["updated_at"], decoded.After["updated_at"])
+	assert.Equal(t, json.Number("7"), decoded.Before["id"])
+}
+
+func TestDebeziumValuesMatchSchema(t *testing.T) {
+	event := postgres.ChangeEvent{
+		Op:     "delete",
+		Schema: "public",
+		Table:  "order_lines",
+		PK:     map[string]interface{}{"order_id": json.Number("7"), "line": json.Number("2")},
+		Before: map[string]interface{}{"order_id": json.Number("7"), "line": json.Number("2"), "price": json.Number("19.90"), "code": json.Number("42")},
+		Types: map[string]string{
+			"order_id": "integer",
+			"line":     "smallint",
+			"price":    "numeric(10,2)",
+			"code":     "custom_code",
+		},
+		LSN: "0/16B3748",
+	}
+
+	data, err := postgres.EncodeEvent(event, postgres.FormatDebezium)
+	assert.NoError(t, err)
+
+	var dbz postgres.DebeziumEvent
+	assert.NoError(t, json.Unmarshal(data, &dbz))
+	types := make(map[string]string)
+	for _, field := range dbz.Schema.Fields[0].Fields {
+		types[field.Field] = field.Type
+	}
+	assert.Equal(t, "double", types["price"])
+	assert.Equal(t, float64(19.90), dbz.Payload.Before["price"])
+	assert.Equal(t, "string", types["code"])
+	assert.Equal(t, "42", dbz.Payload.Before["code"])
+
+	decoded, err := postgres.DecodeEvent(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "delete", decoded.Op)
+	assert.Equal(t, json.Number("19.90"), decoded.Before["price"])
+}
+
+func TestDebeziumKeyIsOutsideTheValue(t *testing.T) {
+	event := postgres.ChangeEvent{
+		Op:     "insert",
+		Schema: "public",
+		Table:  "order_lines",
+		PK:     map[string]interface{}{"order_id": json.Number("7"), "line": json.Number("2")},
+		After:  map[string]interface{}{"order_id": json.Number("7"), "line": json.Number("2"), "sku": "A"},
+		Types:  map[string]string{"order_id": "integer", "line": "smallint", "sku": "text"},
+		LSN:    "0/16B3748",
+	}
+
+	// Kafka Connect's JSON converter accepts nothing but schema and payload.
+	data, err := postgres.EncodeEvent(event, postgres.FormatDebezium)
+	assert.NoError(t, err)
+	var value map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(data, &value))
+	assert.Len(t, value, 2)
+	assert.Contains(t, value, "schema")
+	assert.Contains(t, value, "payload")
+
+	key, err := postgres.EncodeKey(event, postgres.FormatDebezium)
+	assert.NoError(t, err)
+	var dbzKey postgres.DebeziumKey
+	assert.NoError(t, json.Unmarshal(key, &dbzKey))
+	assert.Equal(t, postgres.Database+".public.order_lines.Key", dbzKey.Schema.Name)
+	assert.Equal(t, []postgres.DebeziumSchema{
+		{Type: "int16", Field: "line"},
+		{Type: "int32", Field: "order_id"},
+	}, dbzKey.Schema.Fields)
+	assert.Equal(t, map[string]interface{}{"order_id": float64(7), "line": float64(2)}, dbzKey.Payload)
+
+	key, err = postgres.EncodeKey(event, postgres.FormatEnvelope)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"order_id":7,"line":2}`, string(key))
+}
@@ -0,0 +1,40 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nats-jetstream/config"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnoseReportsUnreachablePostgresAndBadKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message":"The provided API key is invalid.","code":"invalid_api_key","type":"auth","link":""}`))
+	}))
+	defer server.Close()
+
+	db, err := sql.Open("pgx", "postgres://nobody@127.0.0.1:1/none?connect_timeout=1")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	cfg := &config.ApplicationConfig{
+		MeiliSearch: config.MeiliSearchConfig{ApiUrl: server.URL, ApiKey: "wrong"},
+		Sync:        []config.SyncConfig{{Table: "products", Index: "products", PK: config.KeyColumns{"id"}}},
+	}
+
+	checks := config.Diagnose(context.Background(), cfg, db)
+	assert.Len(t, checks, 2)
+	assert.Equal(t, "postgres connection", checks[0].Name)
+	assert.Equal(t, config.CheckFail, checks[0].Status)
+	assert.Equal(t, "meilisearch", checks[1].Name)
+	assert.Equal(t, config.CheckFail, checks[1].Status)
+	assert.NotEmpty(t, checks[1].Fix)
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"context"
+	"log"
+	"nats-jetstream/pkg/nat"
+	"nats-jetstream/pkg/postgres"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockMessageHandler struct {
+	mock.Mock
+}
+
+func (m *MockMessageHandler) HandleMessage(data []byte, logger *log.Logger) error {
+	args := m.Called(string(data))
+	return args.Error(0)
+}
+
+func TestEmbeddedServerReplay(t *testing.T) {
+	logger := log.New(os.Stdout, "test: ", log.LstdFlags)
+
+	ns, err := nat.StartEmbeddedServer(nat.EmbeddedServerOptions{StoreDir: t.TempDir(), Port: -1}, logger)
+	assert.NoError(t, err)
+	defer ns.Shutdown()
+
+	nc, js, err := (&nat.EmbeddedConnector{Server: ns}).Connect(false)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	subManager := &nat.SubscriptionManagerImpl{JetStream: js}
+	assert.NoError(t, subManager.SetupStream("TEST_STREAM", "TEST_SUBJECT"))
+	assert.NoError(t, subManager.SetupStream("TEST_STREAM", "TEST_SUBJECT"))
+
+	events := []postgres.ChangeEvent{
+		{Op: "insert", Schema: "public", Table: "products", LSN: "0/1"},
+		{Op: "insert", Schema: "public", Table: "orders", LSN: "0/2"},
+		{Op: "delete", Schema: "public", Table: "products", LSN: "0/3"},
+	}
+	for i, event := range events {
+		_, err := js.(*nat.JetStreamContextImpl).JS.PublishMsg(event.Msg("TEST_SUBJECT", []byte(event.LSN), i))
+		assert.NoError(t, err)
+	}
+
+	handler := &MockMessageHandler{}
+	handler.On("HandleMessage", "0/1").Return(nil)
+	handler.On("HandleMessage", "0/3").Return(nil)
+
+	applied, err := subManager.Replay(context.Background(), "TEST_SUBJECT", nat.ReplayOptions{Tables: []string{"products"}}, handler, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	handler.AssertExpectations(t)
+
+	handler = &MockMessageHandler{}
+	handler.On("HandleMessage", "0/3").Return(nil)
+
+	applied, err = subManager.Replay(context.Background(), "TEST_SUBJECT", nat.ReplayOptions{StartSequence: 3}, handler, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, applied)
+	handler.AssertExpectations(t)
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"encoding/json"
+	"nats-jetstream/pkg/postgres"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+const walTransaction = `{
+	"xid": 731,
+	"timestamp": "2026-10-19 08:49:14.806671+00",
+	"change": [
+		{
+			"kind": "insert",
+			"schema": "public",
+			"table": "products",
+			"columnnames": ["id", "name", "price"],
+			"columntypes": ["integer", "text", "numeric"],
+			"columnvalues": [42, "Lamp", 19.90]
+		},
+		{
+			"kind": "delete",
+			"schema": "public",
+			"table": "orders",
+			"oldkeys": {"keynames": ["id"], "keytypes": ["bigint"], "keyvalues": [9007199254740993]}
+		}
+	]
+}`
+
+func TestDecodeWAL2JSONSplitsRows(t *testing.T) {
+	lsn, err := postgres.ParseLSN("0/16B3748")
+	assert.NoError(t, err)
+
+	events, err := postgres.DecodeWAL2JSON([]byte(walTransaction), lsn, map[string][]string{"products": {"id"}})
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	insert := events[0]
+	assert.Equal(t, "insert", insert.Op)
+	assert.Equal(t, "public.products", insert.QualifiedTable())
+	assert.Equal(t, map[string]interface{}{"id": json.Number("42")}, insert.PK)
+	assert.Equal(t, json.Number("19.90"), insert.After["price"])
+	assert.Equal(t, "numeric", insert.Types["price"])
+	assert.Nil(t, insert.Before)
+	assert.Equal(t, "0/16B3748", insert.LSN)
+	assert.Equal(t, uint32(731), insert.XID)
+	assert.Equal(t, time.Date(2026, 10, 19, 8, 49, 14, 806671000, time.UTC), insert.CommitTime)
+
+	remove := events[1]
+	assert.Equal(t, "delete", remove.Op)
+	assert.Nil(t, remove.After)
+	assert.Equal(t, map[string]interface{}{"id": json.Number("9007199254740993")}, remove.PK)
+}
+
+func TestChangeEventRoundTripAndHeaders(t *testing.T) {
+	events, err := postgres.DecodeWAL2JSON([]byte(walTransaction), 0x16B3748, nil)
+	assert.NoError(t, err)
+
+	data, err := json.Marshal(events[1])
+	assert.NoError(t, err)
+
+	decoded, err := postgres.DecodeEvent(data)
+	assert.NoError(t, err)
+	assert.Equal(t, events[1], decoded)
+
+	msg := decoded.Msg("TEST_SUBJECT", data, 1)
+	assert.Equal(t, "public.orders", msg.Header.Get(postgres.HeaderTable))
+	assert.Equal(t, "delete", msg.Header.Get(postgres.HeaderOp))
+	assert.Equal(t, "0/16B3748", msg.Header.Get(postgres.HeaderLSN))
+	assert.Equal(t, "0/16B3748-1", msg.Header.Get(nats.MsgIdHdr))
+}
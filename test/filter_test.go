@@ -0,0 +1,81 @@
+package test
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessChangesProjectsColumns(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "products",
+		Index:     "products",
+		PK:        "id",
+		Columns:   []string{"name"},
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{{
+		Op:    "insert",
+		Table: "products",
+		After: map[string]interface{}{"id": json.Number("1"), "name": "Lamp", "cost": json.Number("7")},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`POST /indexes/products/documents [{"id":1,"name":"Lamp"}]`}, server.Requests())
+}
+
+func TestRowFilterMissBecomesDelete(t *testing.T) {
+	server := recordRequests(t)
+	// Answers the batched filter query: every row matches when its status
+	// column is bound to "published".
+	status := regexp.MustCompile(`\$(\d+)::text::text AS "status"`)
+	db := stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+		if strings.Contains(query, "pg_attribute") {
+			return nil, nil // no TOAST-able columns
+		}
+		result := &stubRows{columns: []string{"i", "matches"}}
+		for i, part := range strings.Split(query, " UNION ALL ") {
+			n, _ := strconv.Atoi(status.FindStringSubmatch(part)[1])
+			result.rows = append(result.rows, []driver.Value{int64(i), args[n-1] == "published"})
+		}
+		return result, nil
+	})
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "products",
+		Index:     "products",
+		PK:        "id",
+		Where:     "status = 'published'",
+		DB:        db.DB,
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": json.Number("1"), "status": "draft"}},
+		{Op: "insert", After: map[string]interface{}{"id": json.Number("2"), "status": "published"}},
+		{Op: "update", PK: map[string]interface{}{"id": json.Number("3")}, After: map[string]interface{}{"id": json.Number("3"), "status": "draft"}},
+		{Op: "delete", PK: map[string]interface{}{"id": json.Number("4")}},
+	})
+	assert.NoError(t, err)
+	var filterQueries int
+	for _, query := range db.Queries() {
+		if strings.Contains(query, handler.Where) {
+			filterQueries++
+		}
+	}
+	assert.Equal(t, 1, filterQueries, "the filter is evaluated for the batch in one query")
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents [{"id":2,"status":"published"}]`,
+		`POST /indexes/products/documents/delete-batch ["3","4"]`,
+	}, server.Requests())
+}
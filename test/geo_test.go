@@ -0,0 +1,58 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoMapping(t *testing.T) {
+	server := recordRequests(t)
+
+	stores := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "stores",
+		Index:     "stores",
+		PK:        "id",
+		Geo:       &meilisearch.GeoMapping{Lat: "lat", Lng: "lng"},
+	}
+	err := stores.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 1, "lat": json.Number("52.5"), "lng": json.Number("13.4")}},
+		{Op: "insert", After: map[string]interface{}{"id": 2, "lat": nil, "lng": nil}},
+	})
+	assert.NoError(t, err)
+
+	listings := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "listings",
+		Index:     "listings",
+		PK:        "id",
+		Geo:       &meilisearch.GeoMapping{Column: "location"},
+	}
+	err = listings.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 1, "location": "0101000020E6100000CDCCCCCCCCCC2A400000000000404A40"}},
+		{Op: "insert", After: map[string]interface{}{"id": 2, "location": "SRID=4326;POINT(13.4 52.5)"}},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`POST /indexes/stores/documents [{"_geo":{"lat":52.5,"lng":13.4},"id":1,"lat":52.5,"lng":13.4},{"_geo":null,"id":2,"lat":null,"lng":null}]`,
+		`POST /indexes/listings/documents [{"_geo":{"lat":52.5,"lng":13.4},"id":1},{"_geo":{"lat":52.5,"lng":13.4},"id":2}]`,
+	}, server.Requests())
+
+	err = listings.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 3, "location": "LINESTRING(0 0, 1 1)"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestGeoMappingValidate(t *testing.T) {
+	assert.NoError(t, (&meilisearch.GeoMapping{Lat: "lat", Lng: "lng"}).Validate())
+	assert.NoError(t, (&meilisearch.GeoMapping{Column: "location"}).Validate())
+	assert.Error(t, (&meilisearch.GeoMapping{Lat: "lat"}).Validate())
+	assert.Error(t, (&meilisearch.GeoMapping{Lat: "lat", Lng: "lng", Column: "location"}).Validate())
+}
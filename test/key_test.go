@@ -0,0 +1,126 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDocumentIDEncoding(t *testing.T) {
+	id := meilisearch.EncodeDocumentID([]interface{}{json.Number("42"), "a-b_c d", true})
+	assert.Equal(t, "42-a_2db_5fc_20d-true", id)
+
+	parts, err := meilisearch.DecodeDocumentID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"42", "a-b_c d", "true"}, parts)
+
+	_, err = meilisearch.DecodeDocumentID("bad_4")
+	assert.Error(t, err)
+}
+
+func TestKeyColumnsScalarOrList(t *testing.T) {
+	var entries []config.SyncConfig
+	err := yaml.Unmarshal([]byte(`
+- table: orders
+  pk: id
+- table: order_lines
+  pk: [order_id, line_no]
+- table: products
+`), &entries)
+	assert.NoError(t, err)
+
+	assert.Equal(t, config.KeyColumns{"id"}, entries[0].PK)
+	assert.Equal(t, "id", entries[0].DocumentID())
+	assert.Equal(t, config.KeyColumns{"order_id", "line_no"}, entries[1].PK)
+	assert.Equal(t, meilisearch.DefaultIDField, entries[1].DocumentID())
+	assert.Empty(t, entries[2].PK)
+}
+
+func TestProcessChangesCompositeKey(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:    server.URL,
+		TableName:  "order_lines",
+		Index:      "order_lines",
+		PK:         meilisearch.DefaultIDField,
+		KeyColumns: []string{"order_id", "line_no"},
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{
+			Op:    "insert",
+			After: map[string]interface{}{"order_id": json.Number("7"), "line_no": json.Number("1"), "sku": "A"},
+		},
+		{
+			Op:     "delete",
+			Before: map[string]interface{}{"order_id": json.Number("7"), "line_no": json.Number("2")},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/order_lines/documents [{"_id":"7-1","line_no":1,"order_id":7,"sku":"A"}]`,
+		`POST /indexes/order_lines/documents/delete-batch ["7-2"]`,
+	}, server.Requests())
+}
+
+func TestEncodeIDStrategies(t *testing.T) {
+	email := []interface{}{"ann@example.com"}
+
+	id, err := meilisearch.EncodeID(meilisearch.IDRaw, email)
+	assert.NoError(t, err)
+	assert.Equal(t, "ann@example.com", id)
+
+	id, err = meilisearch.EncodeID(meilisearch.IDSlugify, email)
+	assert.NoError(t, err)
+	assert.Equal(t, "ann_40example_2ecom", id)
+
+	id, err = meilisearch.EncodeID(meilisearch.IDBase32, email)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[0-9A-V]+$`, id)
+
+	id, err = meilisearch.EncodeID(meilisearch.IDHash, []interface{}{json.Number("7"), "x"})
+	assert.NoError(t, err)
+	assert.Len(t, id, 64)
+
+	long := make([]byte, 600)
+	for i := range long {
+		long[i] = 'a'
+	}
+	_, err = meilisearch.EncodeID(meilisearch.IDSlugify, []interface{}{string(long)})
+	assert.Error(t, err)
+	_, err = meilisearch.EncodeID(meilisearch.IDHash, []interface{}{string(long)})
+	assert.NoError(t, err)
+}
+
+func TestProcessChangeKeepsOriginalKey(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:    server.URL,
+		TableName:  "users",
+		Index:      "users",
+		PK:         meilisearch.DefaultIDField,
+		KeyColumns: []string{"email"},
+		IDStrategy: meilisearch.IDSlugify,
+	}
+
+	assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{
+		Op:    "insert",
+		After: map[string]interface{}{"email": "a/b@x.io"},
+	}))
+	assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{
+		Op: "delete",
+		PK: map[string]interface{}{"email": "a/b@x.io"},
+	}))
+	assert.Equal(t, []string{
+		`POST /indexes/users/documents {"_id":"a_2fb_40x_2eio","email":"a/b@x.io"}`,
+		`DELETE /indexes/users/documents/a_2fb_40x_2eio `,
+	}, server.Requests())
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/checkpoint"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddedTableIsBackfilledBeforeStreaming(t *testing.T) {
+	server := recordRequests(t)
+	// products is in the publication already, reviews is added by the
+	// reconcile and holds one row.
+	db := stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+		switch {
+		case strings.Contains(query, "server_version_num"):
+			return stubRow(int64(150000)), nil
+		case strings.Contains(query, "c.relname") && strings.Contains(query, "to_regclass"):
+			table := strings.ReplaceAll(args[0].(string), `"`, "")
+			return stubRow("public", strings.TrimPrefix(table, "public.")), nil
+		case strings.Contains(query, "puballtables"):
+			return stubRow(false, true), nil
+		case strings.Contains(query, "pg_publication_tables"):
+			return stubRow("public", "products"), nil
+		case strings.Contains(query, "pg_publication_rel"):
+			return stubRow(false), nil
+		case strings.Contains(query, `FROM "public"."reviews"`) && len(args) == 0:
+			return &stubRows{
+				columns: []string{"id", "body", "syncmeili_cursor_0"},
+				rows:    [][]driver.Value{{int64(1), "Great", "1"}},
+			}, nil
+		case strings.Contains(query, "attname = $2"):
+			return stubRow("integer"), nil
+		}
+		return nil, nil
+	})
+
+	store, err := checkpoint.NewFileStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	assert.NoError(t, err)
+	cfg := &config.ApplicationConfig{
+		MeiliSearch: config.MeiliSearchConfig{ApiUrl: server.URL},
+		Replication: config.ReplicationSettings{Publication: "search"},
+		Sync: []config.SyncConfig{
+			{Table: "products", Index: "products", PK: config.KeyColumns{"id"}},
+			{Table: "reviews", Index: "reviews", PK: config.KeyColumns{"id"}},
+		},
+	}
+	manager := config.NewManager(cfg, &config.DatabaseStruct{DB: db.DB}, store, log.New(io.Discard, "", 0))
+
+	assert.NoError(t, manager.ReconcilePublication(context.Background()))
+	assert.Contains(t, db.Queries(), `ALTER PUBLICATION "search" ADD TABLE "public"."reviews"`)
+
+	// The copy is written by the time streaming may start, so no live change
+	// can be overwritten by it.
+	assert.NoError(t, manager.Initialize())
+	var documents []string
+	for _, request := range server.Requests() {
+		if strings.Contains(request, "/documents") {
+			documents = append(documents, request)
+		}
+	}
+	assert.Equal(t, []string{`POST /indexes/reviews/documents [{"body":"Great","id":1}]`}, documents)
+	value, _, _ := store.Load(context.Background(), checkpoint.BackfillKey("reviews"))
+	assert.Equal(t, checkpoint.BackfillDone, value)
+}
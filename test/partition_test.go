@@ -0,0 +1,108 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionResolver(t *testing.T) {
+	// events_2026_10 is a partition of events until it is detached.
+	var mu sync.Mutex
+	attached := true
+	db := stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if args[0] == `"public"."events_2026_10"` && attached {
+			return stubRow("public", "events"), nil
+		}
+		return nil, nil
+	})
+	resolver := postgres.NewPartitionResolver(db.DB)
+	resolver.TTL = time.Second
+	ctx := context.Background()
+	primaryKeys := map[string][]string{"public.events": {"id", "created_at"}}
+
+	event := postgres.ChangeEvent{
+		Op:     "update",
+		Schema: "public",
+		Table:  "events_2026_10",
+		PK:     map[string]interface{}{"id": json.Number("7")},
+		Before: map[string]interface{}{"id": json.Number("7"), "created_at": "2026-10-01"},
+		After:  map[string]interface{}{"id": json.Number("7"), "name": "Launch"},
+	}
+	assert.NoError(t, resolver.Resolve(ctx, &event, primaryKeys))
+	assert.Equal(t, "public.events", event.QualifiedTable())
+	assert.Equal(t, map[string]interface{}{"id": json.Number("7"), "created_at": "2026-10-01"}, event.PK)
+
+	// Other tables are left alone.
+	other := postgres.ChangeEvent{Op: "insert", Schema: "public", Table: "users", PK: map[string]interface{}{"id": 1}}
+	assert.NoError(t, resolver.Resolve(ctx, &other, primaryKeys))
+	assert.Equal(t, "public.users", other.QualifiedTable())
+	assert.Equal(t, map[string]interface{}{"id": 1}, other.PK)
+
+	// Roots are cached until they expire, then a detached partition is its
+	// own root.
+	mu.Lock()
+	attached = false
+	mu.Unlock()
+	root, err := resolver.Root(ctx, postgres.TableName{Schema: "public", Name: "events_2026_10"})
+	assert.NoError(t, err)
+	assert.Equal(t, "public.events", root.String())
+
+	time.Sleep(resolver.TTL)
+	root, err = resolver.Root(ctx, postgres.TableName{Schema: "public", Name: "events_2026_10"})
+	assert.NoError(t, err)
+	assert.Equal(t, "public.events_2026_10", root.String())
+}
+
+func TestReplicationResolvesPartitions(t *testing.T) {
+	server := serveReplication(t)
+	db := stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+		if args[0] == `"public"."events_2026_10"` {
+			return stubRow("public", "events"), nil
+		}
+		return nil, nil
+	})
+
+	received := make(chan []byte, 1)
+	cfg := postgres.ReplicationConfig{
+		PrimaryKeys: map[string][]string{"public.events": {"id"}},
+		Partitions:  postgres.NewPartitionResolver(db.DB),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		postgres.StartReplicationDatabase(ctx, nil, func(data []byte) { received <- data }, cfg, log.New(io.Discard, "", 0))
+		close(stopped)
+	}()
+
+	// The change of an uncached partition is resolved while the loop waits
+	// for the next message, not with the receive deadline.
+	server.SendWAL(0x2000, `{"xid":1,"change":[{"kind":"insert","schema":"public","table":"events_2026_10","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[7,"Launch"]}]}`)
+	select {
+	case data := <-received:
+		event, err := postgres.DecodeEvent(data)
+		assert.NoError(t, err)
+		assert.Equal(t, "public.events", event.QualifiedTable())
+		assert.Equal(t, map[string]interface{}{"id": json.Number("7")}, event.PK)
+	case <-time.After(5 * time.Second):
+		t.Fatal("change event not received")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replication did not stop")
+	}
+}
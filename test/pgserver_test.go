@@ -0,0 +1,182 @@
+package test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// replicationServer stands in for Postgres on a replication connection. It
+// reports no replication slot, so one is created, and after START_REPLICATION
+// it streams the messages handed to Send. Standby status updates sent back
+// by the client arrive on Updates.
+type replicationServer struct {
+	Addr    string
+	Updates chan postgres.StandbyStatusUpdate
+
+	listener net.Listener
+	stream   chan []byte
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// serveReplication starts a replicationServer and points the postgres
+// package at it until the test ends.
+func serveReplication(t *testing.T) *replicationServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &replicationServer{
+		Addr:     listener.Addr().String(),
+		Updates:  make(chan postgres.StandbyStatusUpdate, 16),
+		listener: listener,
+		stream:   make(chan []byte, 16),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.accept()
+
+	host, port, _ := net.SplitHostPort(s.Addr)
+	previousHost, previousPort := postgres.Host, postgres.Port
+	postgres.Host, postgres.Port = host, port
+	t.Cleanup(func() { postgres.Host, postgres.Port = previousHost, previousPort })
+	return s
+}
+
+// Queries returns the commands received so far.
+func (s *replicationServer) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// SendWAL streams a wal2json transaction starting at lsn.
+func (s *replicationServer) SendWAL(lsn postgres.LSN, data string) {
+	msg := []byte{postgres.XLogDataByteID}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(lsn))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(lsn))
+	msg = binary.BigEndian.AppendUint64(msg, 0)
+	s.stream <- append(msg, data...)
+}
+
+// SendKeepalive reports walEnd as the end of the WAL and asks for an
+// immediate status update.
+func (s *replicationServer) SendKeepalive(walEnd postgres.LSN) {
+	msg := []byte{postgres.PrimaryKeepaliveMessageByteID}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(walEnd))
+	msg = binary.BigEndian.AppendUint64(msg, 0)
+	s.stream <- append(msg, 1)
+}
+
+// NextUpdate waits for the next standby status update.
+func (s *replicationServer) NextUpdate(t *testing.T) postgres.StandbyStatusUpdate {
+	select {
+	case update := <-s.Updates:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no standby status update received")
+		return postgres.StandbyStatusUpdate{}
+	}
+}
+
+func (s *replicationServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *replicationServer) serve(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		query, ok := msg.(*pgproto3.Query)
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		s.queries = append(s.queries, query.String)
+		s.mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(query.String, "IDENTIFY_SYSTEM"):
+			backend.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+				{Name: []byte("systemid")}, {Name: []byte("timeline")}, {Name: []byte("xlogpos")}, {Name: []byte("dbname")},
+			}})
+			backend.Send(&pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("1"), []byte("0/1000"), []byte(postgres.Database)}})
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("IDENTIFY_SYSTEM")})
+		case strings.HasPrefix(query.String, "START_REPLICATION"):
+			backend.Send(&pgproto3.CopyBothResponse{})
+			if err := backend.Flush(); err != nil {
+				return
+			}
+			s.replicate(backend)
+			return
+		default:
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+		}
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		if err := backend.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// replicate streams the queued messages and decodes the status updates.
+func (s *replicationServer) replicate(backend *pgproto3.Backend) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case data := <-s.stream:
+				backend.Send(&pgproto3.CopyData{Data: data})
+				if err := backend.Flush(); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		copyData, ok := msg.(*pgproto3.CopyData)
+		if !ok || len(copyData.Data) < 17 || copyData.Data[0] != postgres.StandbyStatusUpdateByteID {
+			continue
+		}
+		s.Updates <- postgres.StandbyStatusUpdate{
+			WALWritePosition: postgres.LSN(binary.BigEndian.Uint64(copyData.Data[1:])),
+			WALFlushPosition: postgres.LSN(binary.BigEndian.Uint64(copyData.Data[9:])),
+		}
+	}
+}
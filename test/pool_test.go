@@ -0,0 +1,106 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatermark(t *testing.T) {
+	var w postgres.Watermark
+	assert.Equal(t, postgres.LSN(500), w.Confirmable(500))
+
+	w.Add(100)
+	w.Add(100)
+	w.Add(300)
+	assert.Equal(t, postgres.LSN(99), w.Confirmable(500))
+
+	w.Done(300)
+	w.Done(100)
+	assert.Equal(t, postgres.LSN(99), w.Confirmable(500), "one change of the transaction at 100 is still pending")
+	w.Done(100)
+	assert.Equal(t, postgres.LSN(500), w.Confirmable(500))
+	assert.Zero(t, w.Pending())
+}
+
+func TestApplyPoolKeepsDocumentOrder(t *testing.T) {
+	var mu sync.Mutex
+	last := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var docs []map[string]interface{}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &docs)
+		// Slow writes to one table must not hold back the other.
+		if r.URL.Path == "/indexes/slow/documents" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		for _, doc := range docs {
+			last[r.URL.Path+"/"+doc["id"].(string)] = doc["version"].(string)
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	fast := &meilisearch.MeiliSearchHandler{BaseURL: server.URL, TableName: "fast", Index: "fast", PK: "id"}
+	slow := &meilisearch.MeiliSearchHandler{BaseURL: server.URL, TableName: "slow", Index: "slow", PK: "id"}
+
+	var watermark postgres.Watermark
+	pool := meilisearch.NewApplyPool(4, 8, &watermark, log.New(io.Discard, "", 0))
+	ids := []string{"a", "b", "c", "d", "e"}
+	for version := 1; version <= 20; version++ {
+		lsn := postgres.LSN(version * 100).String()
+		for _, id := range ids {
+			for _, handler := range []*meilisearch.MeiliSearchHandler{fast, slow} {
+				pool.Submit(handler, postgres.ChangeEvent{
+					Op:    "update",
+					LSN:   lsn,
+					PK:    map[string]interface{}{"id": id},
+					After: map[string]interface{}{"id": id, "version": string(rune('A' + version))},
+				})
+			}
+		}
+	}
+	assert.Less(t, watermark.Confirmable(postgres.LSN(2000)), postgres.LSN(2000))
+	pool.Close()
+
+	assert.Zero(t, watermark.Pending())
+	assert.Equal(t, postgres.LSN(2000), watermark.Confirmable(2000))
+	for _, id := range ids {
+		assert.Equal(t, string(rune('A'+20)), last["/indexes/fast/documents/"+id])
+		assert.Equal(t, string(rune('A'+20)), last["/indexes/slow/documents/"+id])
+	}
+}
+
+func TestApplyPoolHoldsWatermarkOnFailure(t *testing.T) {
+	server := recordRequests(t)
+	server.Respond(http.StatusInternalServerError)
+	handler := &meilisearch.MeiliSearchHandler{BaseURL: server.URL, TableName: "products", Index: "products", PK: "id"}
+
+	var watermark postgres.Watermark
+	pool := meilisearch.NewApplyPool(2, 8, &watermark, log.New(io.Discard, "", 0))
+	pool.Submit(handler, postgres.ChangeEvent{
+		Op:    "insert",
+		LSN:   postgres.LSN(300).String(),
+		After: map[string]interface{}{"id": 1},
+	})
+
+	assert.Eventually(t, func() bool { return len(server.Requests()) >= 2 }, 5*time.Second, 10*time.Millisecond, "the write is retried")
+	assert.Equal(t, postgres.LSN(299), watermark.Confirmable(500), "the failed change stays pending")
+
+	server.Respond(http.StatusAccepted)
+	pool.Close()
+	assert.Equal(t, postgres.LSN(500), watermark.Confirmable(500))
+	assert.Zero(t, watermark.Pending())
+}
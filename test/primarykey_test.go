@@ -0,0 +1,75 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"testing"
+
+	"nats-jetstream/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keyCatalog answers the catalog queries of ResolvePrimaryKeys: orders has
+// the primary key (id), lines (order_id, line), and events none but a
+// unique index on uuid.
+func keyCatalog(query string, args []driver.Value) (*stubRows, error) {
+	switch {
+	case strings.Contains(query, "IS NOT NULL"):
+		return stubRow(args[0] != `"public"."missing"`), nil
+	case strings.Contains(query, "pg_constraint"):
+		keys := map[string][]string{
+			`"public"."orders"`: {"id"},
+			`"public"."lines"`:  {"order_id", "line"},
+		}[args[0].(string)]
+		rows := &stubRows{columns: []string{"attname"}}
+		for _, key := range keys {
+			rows.rows = append(rows.rows, []driver.Value{key})
+		}
+		return rows, nil
+	case strings.Contains(query, "indisunique"):
+		return stubRow(args[0] == `"public"."events"` && slices.Equal(args[2].([]string), []string{"uuid"})), nil
+	}
+	return nil, nil
+}
+
+func TestResolvePrimaryKeys(t *testing.T) {
+	db := stubDB(t, keyCatalog)
+	logger := log.New(io.Discard, "", 0)
+	resolve := func(entry config.SyncConfig) (config.KeyColumns, error) {
+		entries, err := config.ResolvePrimaryKeys(context.Background(), db.DB, []config.SyncConfig{entry}, logger)
+		if err != nil {
+			return nil, err
+		}
+		return entries[0].PK, nil
+	}
+
+	// A missing pk is taken from the primary key.
+	pk, err := resolve(config.SyncConfig{Table: "orders", Index: "orders"})
+	assert.NoError(t, err)
+	assert.Equal(t, config.KeyColumns{"id"}, pk)
+
+	// A configured pk must match it, in any order; the configured order is
+	// kept, it defines the document id.
+	pk, err = resolve(config.SyncConfig{Table: "lines", Index: "lines", PK: config.KeyColumns{"line", "order_id"}})
+	assert.NoError(t, err)
+	assert.Equal(t, config.KeyColumns{"line", "order_id"}, pk)
+	_, err = resolve(config.SyncConfig{Table: "orders", Index: "orders", PK: config.KeyColumns{"code"}})
+	assert.ErrorContains(t, err, "pk (code) of table public.orders does not match its primary key (id)")
+
+	// Without a primary key, pk must be given and form a unique index.
+	_, err = resolve(config.SyncConfig{Table: "events", Index: "events"})
+	assert.ErrorContains(t, err, "table public.events has no primary key; set pk")
+	pk, err = resolve(config.SyncConfig{Table: "events", Index: "events", PK: config.KeyColumns{"uuid"}})
+	assert.NoError(t, err)
+	assert.Equal(t, config.KeyColumns{"uuid"}, pk)
+	_, err = resolve(config.SyncConfig{Table: "events", Index: "events", PK: config.KeyColumns{"name"}})
+	assert.ErrorContains(t, err, "table public.events has no primary key and pk (name) is not unique")
+
+	_, err = resolve(config.SyncConfig{Table: "missing", Index: "missing"})
+	assert.ErrorContains(t, err, "table public.missing does not exist")
+}
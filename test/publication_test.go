@@ -0,0 +1,54 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicationPublishesViaPartitionRoot(t *testing.T) {
+	publication := func(version int64, exists bool) *sqlStub {
+		return stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+			switch {
+			case strings.Contains(query, "server_version_num"):
+				return stubRow(version), nil
+			case strings.Contains(query, "pg_publication_rel"):
+				return stubRow(false), nil
+			case strings.Contains(query, "to_regclass"):
+				return stubRow("public", "events"), nil
+			case strings.Contains(query, "puballtables") && exists:
+				return stubRow(false, false), nil
+			case strings.Contains(query, "pg_publication_tables"):
+				return stubRow("public", "events"), nil
+			}
+			return nil, nil
+		})
+	}
+	logger := log.New(io.Discard, "", 0)
+	ctx := context.Background()
+
+	// A new publication publishes partitions under their root on Postgres
+	// 13+, and cannot before.
+	db := publication(150000, false)
+	_, err := postgres.ReconcilePublication(ctx, db.DB, "search", []string{"events"}, logger)
+	assert.NoError(t, err)
+	assert.Contains(t, db.Queries(), `CREATE PUBLICATION "search" FOR TABLE "public"."events" WITH (publish_via_partition_root = true)`)
+
+	db = publication(120000, false)
+	_, err = postgres.ReconcilePublication(ctx, db.DB, "search", []string{"events"}, logger)
+	assert.NoError(t, err)
+	assert.Contains(t, db.Queries(), `CREATE PUBLICATION "search" FOR TABLE "public"."events"`)
+
+	// An existing publication is switched over.
+	db = publication(150000, true)
+	_, err = postgres.ReconcilePublication(ctx, db.DB, "search", []string{"events"}, logger)
+	assert.NoError(t, err)
+	assert.Contains(t, db.Queries(), `ALTER PUBLICATION "search" SET (publish_via_partition_root = true)`)
+}
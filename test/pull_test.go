@@ -0,0 +1,107 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"nats-jetstream/pkg/checkpoint"
+	"nats-jetstream/pkg/nat"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyBatchHandler fails the first deferred batch holding "1" once release
+// is closed, and records every batch it is given.
+type flakyBatchHandler struct {
+	mu      sync.Mutex
+	calls   []string
+	failed  bool
+	release chan struct{}
+}
+
+func (h *flakyBatchHandler) record(call string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, call)
+}
+
+func (h *flakyBatchHandler) Calls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+func (h *flakyBatchHandler) HandleBatch(batch [][]byte, l *log.Logger) error {
+	h.record("retry " + string(batch[0]))
+	return nil
+}
+
+func (h *flakyBatchHandler) HandleBatchDeferred(batch [][]byte, l *log.Logger, done func(error)) {
+	h.record("deferred " + string(batch[0]))
+	h.mu.Lock()
+	fail := string(batch[0]) == "1" && !h.failed
+	h.failed = true
+	h.mu.Unlock()
+	if fail {
+		go func() {
+			<-h.release
+			done(errors.New("meilisearch unavailable"))
+		}()
+		return
+	}
+	done(nil)
+}
+
+func TestFailedDeferredBatchHoldsBackLaterBatches(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	ns, err := nat.StartEmbeddedServer(nat.EmbeddedServerOptions{StoreDir: t.TempDir(), Port: -1}, logger)
+	assert.NoError(t, err)
+	defer ns.Shutdown()
+
+	nc, js, err := (&nat.EmbeddedConnector{Server: ns}).Connect(false)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	store, err := checkpoint.NewFileStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	assert.NoError(t, err)
+	subManager := &nat.SubscriptionManagerImpl{JetStream: js, Checkpoints: store}
+	assert.NoError(t, subManager.SetupStream("PULL_STREAM", "PULL_SUBJECT"))
+
+	publish := func(data string) {
+		_, err := js.(*nat.JetStreamContextImpl).JS.Publish("PULL_SUBJECT", []byte(data))
+		assert.NoError(t, err)
+	}
+	applied := func() string {
+		value, _, _ := store.Load(context.Background(), checkpoint.ConsumerKey("pull"))
+		return value
+	}
+
+	handler := &flakyBatchHandler{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := nat.PullOptions{BatchSize: 1, FetchTimeout: 50 * time.Millisecond}
+	assert.NoError(t, subManager.PullSubscribeWithBatchHandler(ctx, "PULL_SUBJECT", "pull", opts, handler, logger))
+
+	for _, data := range []string{"1", "2", "3"} {
+		publish(data)
+	}
+	assert.Eventually(t, func() bool { return len(handler.Calls()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, applied(), "batches after the unfinished one are not checkpointed")
+
+	// The failed batch is applied again before anything else is fetched,
+	// followed by the batches after it, so their newer rows win.
+	close(handler.release)
+	assert.Eventually(t, func() bool { return applied() == "3" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"deferred 1", "deferred 2", "deferred 3", "retry 1", "retry 2", "retry 3"}, handler.Calls())
+
+	publish("4")
+	assert.Eventually(t, func() bool { return applied() == "4" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "deferred 4", handler.Calls()[6])
+}
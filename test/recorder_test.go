@@ -0,0 +1,67 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingServer stands in for Meilisearch. It records every write as
+// "METHOD path body", with the path escaped, and answers it with a task.
+// Looking up an index succeeds, as if every index existed with primary key
+// id; lookups are not recorded.
+type recordingServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+	status   int
+}
+
+// recordRequests starts a recordingServer that is closed with the test.
+func recordRequests(t *testing.T) *recordingServer {
+	s := &recordingServer{status: http.StatusAccepted}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *recordingServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.Method == http.MethodGet && strings.Count(r.URL.Path, "/") == 2 && strings.HasPrefix(r.URL.Path, "/indexes/") {
+		fmt.Fprintf(w, `{"uid":%q,"primaryKey":"id"}`, strings.TrimPrefix(r.URL.Path, "/indexes/"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.EscapedPath()+" "+string(body))
+	w.WriteHeader(s.status)
+	fmt.Fprintf(w, `{"taskUid":%d}`, len(s.requests))
+}
+
+// Requests returns the writes received so far.
+func (s *recordingServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Reset forgets the writes received so far.
+func (s *recordingServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// Respond makes the server answer writes with status, such as
+// http.StatusInternalServerError to fail them.
+func (s *recordingServer) Respond(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
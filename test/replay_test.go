@@ -0,0 +1,92 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/nat"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayIntoIndexes(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	server := recordRequests(t)
+
+	ns, err := nat.StartEmbeddedServer(nat.EmbeddedServerOptions{StoreDir: t.TempDir(), Port: -1}, logger)
+	assert.NoError(t, err)
+	defer ns.Shutdown()
+	nc, js, err := (&nat.EmbeddedConnector{Server: ns}).Connect(false)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	subManager := &nat.SubscriptionManagerImpl{JetStream: js}
+	assert.NoError(t, subManager.SetupStream("REPLAY_STREAM", "REPLAY_SUBJECT"))
+
+	// Events in both output formats, as a stream written before and after
+	// a change of EVENT_FORMAT holds them.
+	events := []struct {
+		event  postgres.ChangeEvent
+		format string
+	}{
+		{postgres.ChangeEvent{Op: "insert", Schema: "public", Table: "products", LSN: "0/1", After: map[string]interface{}{"id": json.Number("1"), "name": "Lamp"}, Types: map[string]string{"id": "integer", "name": "text"}}, postgres.FormatEnvelope},
+		{postgres.ChangeEvent{Op: "insert", Schema: "public", Table: "orders", LSN: "0/2", After: map[string]interface{}{"id": json.Number("9")}}, postgres.FormatEnvelope},
+		{postgres.ChangeEvent{Op: "delete", Schema: "public", Table: "products", LSN: "0/3", PK: map[string]interface{}{"id": json.Number("1")}, Before: map[string]interface{}{"id": json.Number("1")}, Types: map[string]string{"id": "integer"}}, postgres.FormatDebezium},
+	}
+	for i, e := range events {
+		data, err := postgres.EncodeEvent(e.event, e.format)
+		assert.NoError(t, err)
+		_, err = js.(*nat.JetStreamContextImpl).JS.PublishMsg(e.event.Msg("REPLAY_SUBJECT", data, i))
+		assert.NoError(t, err)
+	}
+
+	cfg := &config.ApplicationConfig{
+		MeiliSearch: config.MeiliSearchConfig{ApiUrl: server.URL},
+		Sync: []config.SyncConfig{
+			{Table: "products", Index: "products", PK: config.KeyColumns{"id"}},
+			{Table: "orders", Index: "orders", PK: config.KeyColumns{"id"}},
+		},
+	}
+	manager := config.NewManager(cfg, nil, nil, logger)
+	assert.NoError(t, manager.InitializeForReplay())
+
+	applied, err := subManager.Replay(context.Background(), "REPLAY_SUBJECT", nat.ReplayOptions{Tables: []string{"products"}}, manager.GetMessageHandler(), logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, applied)
+
+	// Only the selected table is written, in stream order.
+	documents := func() []string {
+		var writes []string
+		for _, request := range server.Requests() {
+			if strings.Contains(request, "/documents") {
+				writes = append(writes, request)
+			}
+		}
+		return writes
+	}
+	assert.Eventually(t, func() bool { return len(documents()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents {"id":1,"name":"Lamp"}`,
+		`DELETE /indexes/products/documents/1 `,
+	}, documents())
+}
+
+func TestReplayNeedsDatabaseForRowFilters(t *testing.T) {
+	// A filtered row is checked against the database before it is written,
+	// so replay needs a connection even when every table and key is given.
+	entries := []config.SyncConfig{
+		{Table: "products", Index: "products", PK: config.KeyColumns{"id"}},
+		{Table: "orders", Index: "orders", PK: config.KeyColumns{"id"}, Where: "status = 'paid'"},
+	}
+	assert.False(t, config.HasWildcards(entries))
+	assert.False(t, config.HasMissingKeys(entries))
+	assert.True(t, config.HasRowFilters(entries))
+	assert.False(t, config.HasRowFilters(entries[:1]))
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"nats-jetstream/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushConsumerRoutesChangesByTable(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	meili := recordRequests(t)
+	pg := serveReplication(t)
+
+	streamService, consumerMode := config.StreamService, config.ConsumerMode
+	embedded, storeDir, port := config.NatsEmbedded, config.NatsStoreDir, config.NatsEmbeddedPort
+	subject, streamName, durableName := config.Subject, config.StreamName, config.DurableName
+	t.Cleanup(func() {
+		config.StreamService, config.ConsumerMode = streamService, consumerMode
+		config.NatsEmbedded, config.NatsStoreDir, config.NatsEmbeddedPort = embedded, storeDir, port
+		config.Subject, config.StreamName, config.DurableName = subject, streamName, durableName
+	})
+	config.StreamService, config.ConsumerMode = "jetstream", "push"
+	config.NatsEmbedded, config.NatsStoreDir, config.NatsEmbeddedPort = true, t.TempDir(), -1
+	config.Subject, config.StreamName, config.DurableName = "PUSH_SUBJECT", "PUSH_STREAM", "push"
+
+	cfg := &config.ApplicationConfig{
+		MeiliSearch: config.MeiliSearchConfig{ApiUrl: meili.URL},
+		Sync: []config.SyncConfig{
+			{Table: "products", Index: "products", PK: config.KeyColumns{"id"}},
+			{Table: "orders", Index: "orders", PK: config.KeyColumns{"id"}},
+		},
+	}
+	manager := config.NewManager(cfg, nil, nil, logger)
+	assert.NoError(t, manager.InitializeForReplay())
+
+	// One durable serves every table, so starting with two tables must not
+	// bind it twice.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service := config.NewService(cfg, logger)
+	assert.NoError(t, service.StartReplication(ctx, nil, manager.GetReplicationConfig(), manager.GetMessageHandler(), manager.GetBatchHandler()))
+
+	pg.SendWAL(0x2000, `{"xid":1,"change":[`+
+		`{"kind":"insert","schema":"public","table":"products","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[1,"Lamp"]},`+
+		`{"kind":"insert","schema":"public","table":"orders","columnnames":["id"],"columntypes":["integer"],"columnvalues":[9]}]}`)
+
+	documents := func() []string {
+		var writes []string
+		for _, request := range meili.Requests() {
+			if strings.Contains(request, "/documents") {
+				writes = append(writes, request)
+			}
+		}
+		return writes
+	}
+	assert.Eventually(t, func() bool { return len(documents()) == 2 }, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents {"id":1,"name":"Lamp"}`,
+		`POST /indexes/orders/documents {"id":9}`,
+	}, documents())
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slotCatalog is a source database holding the syncmeili_checkpoints table
+// and the given replication slots.
+type slotCatalog struct {
+	mu          sync.Mutex
+	checkpoints map[string]string
+	slots       map[string]bool
+}
+
+func (c *slotCatalog) answer(query string, args []driver.Value) (*stubRows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case strings.Contains(query, "CREATE TABLE"):
+		return nil, nil
+	case strings.Contains(query, "SELECT value FROM syncmeili_checkpoints"):
+		value, ok := c.checkpoints[args[0].(string)]
+		if !ok {
+			return nil, nil
+		}
+		return stubRow(value), nil
+	case strings.Contains(query, "INSERT INTO syncmeili_checkpoints"):
+		c.checkpoints[args[0].(string)] = args[1].(string)
+		return nil, nil
+	case strings.Contains(query, "pg_replication_slots"):
+		return stubRow(c.slots[args[0].(string)]), nil
+	}
+	return nil, nil
+}
+
+func TestClaimSlot(t *testing.T) {
+	catalog := &slotCatalog{checkpoints: map[string]string{}, slots: map[string]bool{"search": true}}
+	db := stubDB(t, catalog.answer)
+	ctx := context.Background()
+
+	staging := postgres.ReplicationConfig{SlotName: "search", Publication: "search_staging", ApplicationName: "staging"}
+	production := postgres.ReplicationConfig{SlotName: "search", Publication: "search_production", ApplicationName: "production"}
+
+	// The first configuration to start owns the slot, in the database.
+	assert.NoError(t, postgres.ClaimSlot(ctx, db.DB, staging))
+	assert.Equal(t, "publication=search_staging application_name=staging", catalog.checkpoints["replication.search.owner"])
+	assert.NoError(t, postgres.ClaimSlot(ctx, db.DB, staging))
+
+	err := postgres.ClaimSlot(ctx, db.DB, production)
+	assert.ErrorContains(t, err, "replication slot search belongs to a different configuration")
+
+	// Once the slot is dropped, another configuration may take the name.
+	catalog.mu.Lock()
+	catalog.slots["search"] = false
+	catalog.mu.Unlock()
+	assert.NoError(t, postgres.ClaimSlot(ctx, db.DB, production))
+	assert.Equal(t, "publication=search_production application_name=production", catalog.checkpoints["replication.search.owner"])
+}
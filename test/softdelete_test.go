@@ -0,0 +1,50 @@
+package test
+
+import (
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftDeleteRule(t *testing.T) {
+	deletedAt := &meilisearch.SoftDeleteRule{Column: "deleted_at"}
+	assert.True(t, deletedAt.Deleted(map[string]interface{}{"deleted_at": "2026-10-19 08:49:14"}))
+	assert.False(t, deletedAt.Deleted(map[string]interface{}{"deleted_at": nil}))
+	assert.Equal(t, `t."deleted_at" IS NULL`, deletedAt.LiveSQL())
+
+	archived := &meilisearch.SoftDeleteRule{Column: "is_archived", Condition: meilisearch.SoftDeleteTrue}
+	assert.True(t, archived.Deleted(map[string]interface{}{"is_archived": true}))
+	assert.False(t, archived.Deleted(map[string]interface{}{"is_archived": false}))
+
+	status := &meilisearch.SoftDeleteRule{Column: "status", Condition: meilisearch.SoftDeleteEquals, Value: "it's gone"}
+	assert.True(t, status.Deleted(map[string]interface{}{"status": "it's gone"}))
+	assert.Equal(t, `t."status"::text IS DISTINCT FROM 'it''s gone'`, status.LiveSQL())
+
+	assert.Error(t, (&meilisearch.SoftDeleteRule{Column: "status", Condition: meilisearch.SoftDeleteEquals}).Validate())
+	assert.Error(t, (&meilisearch.SoftDeleteRule{Column: "status", Condition: "maybe"}).Validate())
+}
+
+func TestSoftDeletedUpdateBecomesDelete(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:    server.URL,
+		TableName:  "products",
+		Index:      "products",
+		PK:         "id",
+		SoftDelete: &meilisearch.SoftDeleteRule{Column: "deleted_at"},
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "update", After: map[string]interface{}{"id": 1, "deleted_at": "2026-10-19 08:49:14"}},
+		{Op: "update", After: map[string]interface{}{"id": 1, "deleted_at": nil}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents/delete-batch ["1"]`,
+		`POST /indexes/products/documents [{"deleted_at":null,"id":1}]`,
+	}, server.Requests())
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// stubRows is the answer of a stub query.
+type stubRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// stubAnswer answers a query or statement with rows, or fails it with err.
+// A nil *stubRows answers with no rows.
+type stubAnswer func(query string, args []driver.Value) (*stubRows, error)
+
+// stubRow answers with one row of values.
+func stubRow(values ...driver.Value) *stubRows {
+	columns := make([]string, len(values))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i+1)
+	}
+	return &stubRows{columns: columns, rows: [][]driver.Value{values}}
+}
+
+// sqlStub is a database/sql connection whose queries are answered by a
+// function, for code that reads the Postgres catalog. It records every query
+// and statement it receives.
+type sqlStub struct {
+	DB *sql.DB
+
+	mu      sync.Mutex
+	answer  stubAnswer
+	queries []string
+}
+
+// stubDB opens a sqlStub that is closed with the test.
+func stubDB(t *testing.T, answer stubAnswer) *sqlStub {
+	s := &sqlStub{answer: answer}
+	s.DB = sql.OpenDB(stubConnector{s})
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+// Queries returns the queries and statements received so far.
+func (s *sqlStub) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func (s *sqlStub) run(query string, named []driver.NamedValue) (*stubRows, error) {
+	args := make([]driver.Value, len(named))
+	for i, arg := range named {
+		args[i] = arg.Value
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+	return s.answer(query, args)
+}
+
+type stubConnector struct{ stub *sqlStub }
+
+func (c stubConnector) Connect(context.Context) (driver.Conn, error) { return stubConn(c), nil }
+func (c stubConnector) Driver() driver.Driver                        { return stubDriver{} }
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("stub connections are opened through sql.OpenDB")
+}
+
+type stubConn struct{ stub *sqlStub }
+
+func (c stubConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("stub connections do not prepare statements")
+}
+func (c stubConn) Close() error { return nil }
+func (c stubConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("stub connections have no transactions")
+}
+
+// CheckNamedValue passes every argument through, arrays included.
+func (c stubConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c stubConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.stub.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = &stubRows{}
+	}
+	return &stubCursor{rows: rows}, nil
+}
+
+func (c stubConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, err := c.stub.run(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type stubCursor struct {
+	rows *stubRows
+	next int
+}
+
+func (c *stubCursor) Columns() []string { return c.rows.columns }
+func (c *stubCursor) Close() error      { return nil }
+
+func (c *stubCursor) Next(dest []driver.Value) error {
+	if c.next >= len(c.rows.rows) {
+		return io.EOF
+	}
+	copy(dest, c.rows.rows[c.next])
+	c.next++
+	return nil
+}
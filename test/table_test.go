@@ -0,0 +1,56 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"testing"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTableName(t *testing.T) {
+	assert.Equal(t, postgres.TableName{Schema: "public", Name: "orders"}, postgres.ParseTableName("orders"))
+
+	table := postgres.ParseTableName("tenant_a.Orders")
+	assert.Equal(t, "tenant_a.Orders", table.String())
+	assert.Equal(t, `"tenant_a"."Orders"`, table.Sanitize())
+
+	assert.True(t, config.HasWildcards([]config.SyncConfig{{Table: "orders"}, {Table: "catalog.*"}}))
+	assert.False(t, config.HasWildcards([]config.SyncConfig{{Table: "tenant_a.orders"}}))
+}
+
+func TestRouterRoutesBySchema(t *testing.T) {
+	server := recordRequests(t)
+
+	logger := log.New(os.Stdout, "test: ", 0)
+	router := config.NewRouter([]*meilisearch.MeiliSearchHandler{
+		{BaseURL: server.URL, TableName: "tenant_a.orders", Index: "orders_a", PK: "id"},
+		{BaseURL: server.URL, TableName: "tenant_b.orders", Index: "orders_b", PK: "id"},
+	}, logger)
+
+	var batch [][]byte
+	for _, schema := range []string{"tenant_a", "tenant_b", "tenant_c"} {
+		data, err := json.Marshal(postgres.ChangeEvent{
+			Op:     "insert",
+			Schema: schema,
+			Table:  "orders",
+			After:  map[string]interface{}{"id": 1},
+		})
+		assert.NoError(t, err)
+		batch = append(batch, data)
+	}
+
+	assert.NoError(t, router.HandleBatch(batch, logger))
+	requests := server.Requests()
+	sort.Strings(requests)
+	assert.Equal(t, []string{
+		`POST /indexes/orders_a/documents [{"id":1}]`,
+		`POST /indexes/orders_b/documents [{"id":1}]`,
+	}, requests)
+}
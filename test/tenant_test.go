@@ -0,0 +1,144 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"nats-jetstream/config"
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	meili "github.com/meilisearch/meilisearch-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexColumns(t *testing.T) {
+	assert.Equal(t, []string{"tenant_id"}, meilisearch.IndexColumns("products_{tenant_id}"))
+	assert.Equal(t, []string{"region", "tenant_id"}, meilisearch.IndexColumns("{region}-products-{tenant_id}"))
+	assert.Nil(t, meilisearch.IndexColumns("products"))
+}
+
+func TestTenantIndexRouting(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		Client:     meili.New(server.URL),
+		BaseURL:    server.URL,
+		TableName:  "products",
+		Index:      "products_{tenant_id}",
+		PK:         "_id",
+		KeyColumns: []string{"tenant_id", "id"},
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 1, "tenant_id": 1}},
+		{Op: "insert", After: map[string]interface{}{"id": 2, "tenant_id": "acme corp"}},
+		{Op: "insert", After: map[string]interface{}{"id": 3, "tenant_id": 1}},
+		{Op: "insert", After: map[string]interface{}{"id": 4, "tenant_id": "a_20b"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/products_1/documents [{"_id":"1-1","id":1,"tenant_id":1},{"_id":"1-3","id":3,"tenant_id":1}]`,
+		`POST /indexes/products_acme_20corp/documents [{"_id":"acme_20corp-2","id":2,"tenant_id":"acme corp"}]`,
+		`POST /indexes/products_a_5f20b/documents [{"_id":"a_5f20b-4","id":4,"tenant_id":"a_20b"}]`,
+	}, server.Requests())
+
+	// The tenant is part of the key, so the old row holds it when it
+	// changed: delete there, add to the new one.
+	server.Reset()
+	err = handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "update", Before: map[string]interface{}{"id": 1, "tenant_id": 1}, After: map[string]interface{}{"id": 1, "tenant_id": 2}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/products_1/documents/delete-batch ["1-1"]`,
+		`POST /indexes/products_2/documents [{"_id":"2-1","id":1,"tenant_id":2}]`,
+	}, server.Requests())
+
+	// Without the old key the key, and with it the tenant, is unchanged.
+	server.Reset()
+	err = handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "update", After: map[string]interface{}{"id": 3, "tenant_id": 1, "name": "Lamp"}},
+		{Op: "delete", PK: map[string]interface{}{"id": 3, "tenant_id": 1}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/products_1/documents [{"_id":"1-3","id":3,"name":"Lamp","tenant_id":1}]`,
+		`POST /indexes/products_1/documents/delete-batch ["1-3"]`,
+	}, server.Requests())
+
+	assert.Error(t, handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 5, "tenant_id": nil}},
+	}))
+	assert.Error(t, handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "delete", PK: map[string]interface{}{"id": 5}},
+	}))
+}
+
+func TestTenantOutsideKeyWithFullIdentity(t *testing.T) {
+	server := recordRequests(t)
+
+	// products is keyed on id alone and has REPLICA IDENTITY FULL, so the
+	// old row carries the tenant.
+	handler := &meilisearch.MeiliSearchHandler{
+		Client:    meili.New(server.URL),
+		BaseURL:   server.URL,
+		TableName: "products",
+		Index:     "products_{tenant_id}",
+		PK:        "id",
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{
+			Op:     "update",
+			PK:     map[string]interface{}{"id": 1},
+			Before: map[string]interface{}{"id": 1, "tenant_id": 1, "name": "Lamp"},
+			After:  map[string]interface{}{"id": 1, "tenant_id": 2, "name": "Lamp"},
+		},
+		{
+			Op:     "delete",
+			PK:     map[string]interface{}{"id": 3},
+			Before: map[string]interface{}{"id": 3, "tenant_id": 1, "name": "Desk"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/products_1/documents/delete-batch ["1","3"]`,
+		`POST /indexes/products_2/documents [{"id":1,"name":"Lamp","tenant_id":2}]`,
+	}, server.Requests())
+}
+
+func TestTenantColumnsMustBeInReplicaIdentity(t *testing.T) {
+	// products has the primary key id and no tenant_id in it.
+	identity := "d"
+	db := stubDB(t, func(query string, args []driver.Value) (*stubRows, error) {
+		switch {
+		case strings.Contains(query, "IS NOT NULL"):
+			return stubRow(true), nil
+		case strings.Contains(query, "relreplident"):
+			return stubRow(identity), nil
+		}
+		return stubRow("id"), nil // the primary key
+	})
+	logger := log.New(io.Discard, "", 0)
+	entries := []config.SyncConfig{{Table: "products", Index: "products_{tenant_id}"}}
+
+	_, err := config.ResolvePrimaryKeys(context.Background(), db.DB, entries, logger)
+	assert.ErrorContains(t, err, "column tenant_id of index \"products_{tenant_id}\" must be part of the replica identity")
+
+	// With REPLICA IDENTITY FULL the old tenant is sent with every update
+	// and delete, so it need not be part of the key.
+	identity = "f"
+	resolved, err := config.ResolvePrimaryKeys(context.Background(), db.DB, entries, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, config.KeyColumns{"id"}, resolved[0].PK)
+
+	identity = "d"
+	resolved, err = config.ResolvePrimaryKeys(context.Background(), db.DB, []config.SyncConfig{{Table: "products", Index: "products_{id}"}}, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, config.KeyColumns{"id"}, resolved[0].PK)
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// toastCatalog answers the catalog queries of an articles table whose body
+// column is TOAST-able, and the fetch of the row with id 1.
+func toastCatalog(query string, args []driver.Value) (*stubRows, error) {
+	switch {
+	case strings.Contains(query, "attstorage"):
+		return &stubRows{columns: []string{"attname", "format_type"}, rows: [][]driver.Value{{"body", "text"}}}, nil
+	case strings.Contains(query, "attname = $2"):
+		return stubRow("integer"), nil
+	case strings.Contains(query, "row_to_json"):
+		if args[0] != "1" {
+			return nil, nil
+		}
+		return stubRow(`{"body":"A long story"}`), nil
+	}
+	return nil, nil
+}
+
+// toastUpdate is an update of an article that left its body out.
+func toastUpdate(id string) postgres.ChangeEvent {
+	return postgres.ChangeEvent{
+		Op:    "update",
+		PK:    map[string]interface{}{"id": json.Number(id)},
+		After: map[string]interface{}{"id": json.Number(id), "title": "Renamed"},
+	}
+}
+
+func TestToastPartialUpdate(t *testing.T) {
+	server := recordRequests(t)
+	db := stubDB(t, toastCatalog)
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "articles",
+		Index:     "articles",
+		PK:        "id",
+		DB:        db.DB,
+	}
+
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		toastUpdate("1"),
+		{Op: "update", PK: map[string]interface{}{"id": json.Number("2")}, After: map[string]interface{}{"id": json.Number("2"), "title": "Full", "body": "Short"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`PUT /indexes/articles/documents [{"id":1,"title":"Renamed"}]`,
+		`POST /indexes/articles/documents [{"body":"Short","id":2,"title":"Full"}]`,
+	}, server.Requests())
+}
+
+func TestToastFetchUpdate(t *testing.T) {
+	server := recordRequests(t)
+	db := stubDB(t, toastCatalog)
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "articles",
+		Index:     "articles",
+		PK:        "id",
+		Toast:     meilisearch.ToastFetch,
+		DB:        db.DB,
+	}
+
+	// The body of row 1 is read back; row 2 is gone and falls back to a
+	// partial update.
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{toastUpdate("1"), toastUpdate("2")}))
+	assert.Equal(t, []string{
+		`POST /indexes/articles/documents [{"body":"A long story","id":1,"title":"Renamed"}]`,
+		`PUT /indexes/articles/documents [{"id":2,"title":"Renamed"}]`,
+	}, server.Requests())
+}
+
+func TestToastWithoutDatabase(t *testing.T) {
+	server := recordRequests(t)
+	// As when replaying: there is no catalog, so the omitted body is found
+	// from the old row and the column list, and fetch falls back to partial.
+	for _, mode := range []string{meilisearch.ToastPartial, meilisearch.ToastFetch} {
+		server.Reset()
+		handler := &meilisearch.MeiliSearchHandler{
+			BaseURL:   server.URL,
+			TableName: "articles",
+			Index:     "articles",
+			PK:        "id",
+			Toast:     mode,
+		}
+		full := toastUpdate("1")
+		full.Before = map[string]interface{}{"id": json.Number("1"), "title": "Old", "body": "A long story"}
+		assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{full}))
+
+		handler.Columns = []string{"title", "body"}
+		assert.NoError(t, handler.ProcessChange(toastUpdate("2")))
+		assert.Equal(t, []string{
+			`PUT /indexes/articles/documents [{"id":1,"title":"Renamed"}]`,
+			`PUT /indexes/articles/documents {"id":2,"title":"Renamed"}`,
+		}, server.Requests(), mode)
+	}
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/metrics"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipUnchangedUpdates(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:       server.URL,
+		TableName:     "products",
+		Index:         "products",
+		PK:            "id",
+		IgnoreColumns: []string{"last_seen_at", "view_count"},
+	}
+	skipped := metrics.SkippedUpdates.Value()
+
+	// REPLICA IDENTITY FULL: the old row shows only ignored columns changed.
+	err := handler.ProcessChanges([]postgres.ChangeEvent{{
+		Op:     "update",
+		Before: map[string]interface{}{"id": json.Number("1"), "name": "Lamp", "view_count": json.Number("7")},
+		After:  map[string]interface{}{"id": json.Number("1"), "name": "Lamp", "view_count": json.Number("8")},
+	}})
+	assert.NoError(t, err)
+	assert.Empty(t, server.Requests())
+	assert.Equal(t, skipped+1, metrics.SkippedUpdates.Value())
+
+	// Default identity: only the hash cache can tell.
+	handler.HashCacheSize = 100
+	update := func(name string, views int) postgres.ChangeEvent {
+		return postgres.ChangeEvent{
+			Op:     "update",
+			PK:     map[string]interface{}{"id": 2},
+			Before: map[string]interface{}{"id": 2},
+			After:  map[string]interface{}{"id": 2, "name": name, "view_count": views},
+		}
+	}
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{update("Desk", 1)}))
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{update("Desk", 2)}))
+	assert.NoError(t, handler.ProcessChange(update("Desk", 3)))
+	assert.NoError(t, handler.ProcessChange(update("Standing desk", 4)))
+	assert.Equal(t, []string{
+		`POST /indexes/products/documents [{"id":2,"name":"Desk"}]`,
+		`POST /indexes/products/documents {"id":2,"name":"Standing desk"}`,
+	}, server.Requests())
+	assert.Equal(t, skipped+3, metrics.SkippedUpdates.Value())
+
+	// A delete forgets the document, so writing it again is not skipped.
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{{Op: "delete", PK: map[string]interface{}{"id": 2}}}))
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{update("Standing desk", 5)}))
+	assert.Len(t, server.Requests(), 4)
+}
+
+func TestUpdateRestoringRowIsNotSkipped(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:    server.URL,
+		TableName:  "posts",
+		Index:      "posts",
+		PK:         "id",
+		Columns:    []string{"title"},
+		SoftDelete: &meilisearch.SoftDeleteRule{Column: "deleted_at"},
+	}
+
+	// Only deleted_at, which is not in the document, goes back to NULL: the
+	// projected documents are equal, but the row is visible again.
+	err := handler.ProcessChanges([]postgres.ChangeEvent{{
+		Op:     "update",
+		Before: map[string]interface{}{"id": json.Number("1"), "title": "Hello", "deleted_at": "2024-01-01T00:00:00Z"},
+		After:  map[string]interface{}{"id": json.Number("1"), "title": "Hello", "deleted_at": nil},
+	}})
+	assert.NoError(t, err)
+	assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{
+		Op:     "update",
+		Before: map[string]interface{}{"id": json.Number("2"), "title": "World", "deleted_at": "2024-01-01T00:00:00Z"},
+		After:  map[string]interface{}{"id": json.Number("2"), "title": "World", "deleted_at": nil},
+	}))
+	assert.Equal(t, []string{
+		`POST /indexes/posts/documents [{"id":1,"title":"Hello"}]`,
+		`POST /indexes/posts/documents {"id":2,"title":"World"}`,
+	}, server.Requests())
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	meili "github.com/meilisearch/meilisearch-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVectorColumnsMoveToVectors(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "articles",
+		Index:     "articles",
+		PK:        "id",
+		Vectors:   []meilisearch.VectorMapping{{Column: "embedding"}, {Column: "title_embedding", Embedder: "titles"}},
+	}
+	err := handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 1, "embedding": "[0.1,0.2,0.3]", "title_embedding": nil}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`POST /indexes/articles/documents [{"_vectors":{"default":[0.1,0.2,0.3],"titles":null},"id":1}]`,
+	}, server.Requests())
+
+	assert.Error(t, meilisearch.ValidateVectors([]meilisearch.VectorMapping{{Column: "a"}, {Column: "b"}}))
+	assert.NoError(t, meilisearch.ValidateVectors([]meilisearch.VectorMapping{{Column: "a"}, {Column: "b", Embedder: "b"}}))
+}
+
+func TestPrepareIndexDeclaresEmbedders(t *testing.T) {
+	var updates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/indexes/articles":
+			w.Write([]byte(`{"uid":"articles","primaryKey":"id"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/indexes/articles/settings/embedders":
+			w.Write([]byte(`{"titles":{"source":"userProvided","dimensions":3}}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/indexes/articles/settings/embedders":
+			body, _ := io.ReadAll(r.Body)
+			updates = append(updates, string(body))
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"taskUid":1}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	handler := &meilisearch.MeiliSearchHandler{
+		Client:    meili.New(server.URL),
+		TableName: "articles",
+		Index:     "articles",
+		PK:        "id",
+		Vectors: []meilisearch.VectorMapping{
+			{Column: "embedding", Dimensions: 1536},
+			{Column: "title_embedding", Embedder: "titles", Dimensions: 3},
+		},
+	}
+	handler.PrepareIndex(log.New(io.Discard, "", 0))
+	assert.Equal(t, []string{`{"default":{"source":"userProvided","dimensions":1536}}`}, updates)
+}
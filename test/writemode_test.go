@@ -0,0 +1,38 @@
+package test
+
+import (
+	"testing"
+
+	"nats-jetstream/pkg/meilisearch"
+	"nats-jetstream/pkg/postgres"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteModeMergeUsesPut(t *testing.T) {
+	server := recordRequests(t)
+
+	handler := &meilisearch.MeiliSearchHandler{
+		BaseURL:   server.URL,
+		TableName: "products",
+		Index:     "products",
+		PK:        "id",
+		WriteMode: meilisearch.WriteMerge,
+	}
+
+	assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{Op: "update", After: map[string]interface{}{"id": 1, "name": "Lamp"}}))
+	assert.NoError(t, handler.ProcessChanges([]postgres.ChangeEvent{
+		{Op: "insert", After: map[string]interface{}{"id": 2, "name": "Desk"}},
+		{Op: "delete", PK: map[string]interface{}{"id": 3}},
+	}))
+
+	handler.WriteMode = meilisearch.WriteReplace
+	assert.NoError(t, handler.ProcessChange(postgres.ChangeEvent{Op: "update", After: map[string]interface{}{"id": 1, "name": "Lamp"}}))
+
+	assert.Equal(t, []string{
+		`PUT /indexes/products/documents {"id":1,"name":"Lamp"}`,
+		`PUT /indexes/products/documents [{"id":2,"name":"Desk"}]`,
+		`POST /indexes/products/documents/delete-batch ["3"]`,
+		`POST /indexes/products/documents {"id":1,"name":"Lamp"}`,
+	}, server.Requests())
+}